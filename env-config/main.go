@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/dop251/goja"
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
@@ -14,6 +15,10 @@ import (
 	"github.com/pocketbase/pocketbase/plugins/migratecmd"
 )
 
+// JsvmBindings are called for every pb_hooks and pb_migrations runtime.
+// They must be added before Init, since the runtimes are created there.
+var JsvmBindings = []func(vm *goja.Runtime){}
+
 func Init(app *pocketbase.PocketBase, collections ...string) error {
 
 	var hooksDir string = os.Getenv("PB_HOOKS_DIR")
@@ -69,6 +74,11 @@ func Init(app *pocketbase.PocketBase, collections ...string) error {
 	}
 
 	jsvm.MustRegister(app, jsvm.Config{
+		OnInit: func(vm *goja.Runtime) {
+			for _, bind := range JsvmBindings {
+				bind(vm)
+			}
+		},
 		MigrationsDir: migrationsDir,
 		HooksDir:      hooksDir,
 		HooksWatch:    hooksWatch,
@@ -0,0 +1,177 @@
+package full_text_search
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// ExportFlushEvery is how many rows are written between flushes of the
+// underlying writer, when it supports flushing.
+var ExportFlushEvery = 100
+
+type ExportOptions struct {
+	// Format is either FormatCSV or FormatNDJSON.
+	Format string
+	// Columns are the exported record fields, plus "rank" and "score".
+	// Defaults to all public fields of the collection, and any other
+	// column is an error.
+	Columns []string
+}
+
+// Export writes every record that matches q to w, row by row as they are
+// read from the database. The page options are ignored.
+func Export(app *pocketbase.PocketBase, target string, q string, options SearchOptions, export ExportOptions, w io.Writer) error {
+	collection, err := findCollectionFts(app, target)
+	if err != nil {
+		return err
+	}
+	if export.Format != FormatCSV && export.Format != FormatNDJSON {
+		return fmt.Errorf("unsupported export format %q", export.Format)
+	}
+
+	columns := exportColumns(collection)
+	if len(export.Columns) > 0 {
+		for _, column := range export.Columns {
+			if !slices.Contains(columns, column) {
+				return apis.NewBadRequestError("Invalid export field "+column+".", nil)
+			}
+		}
+		columns = export.Columns
+	}
+
+	match, err := newMatch(app, collection, q, options)
+	if err != nil {
+		return err
+	}
+	scorer, err := newScorer(app, collection, match, options)
+	if err != nil {
+		return err
+	}
+	query, err := matchQuery(app, collection, match, options)
+	if err != nil {
+		return err
+	}
+	rows, err := scorer.filter(collection, query, options).
+		AndSelect("[[" + scorer.fts + ".rank]] AS __rank").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var csvWriter *csv.Writer
+	var jsonEncoder *json.Encoder
+	if export.Format == FormatCSV {
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(columns); err != nil {
+			return err
+		}
+	} else {
+		jsonEncoder = json.NewEncoder(w)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	for rows.Next() {
+		data := dbx.NullStringMap{}
+		if err := rows.ScanMap(data); err != nil {
+			return err
+		}
+		rank, _ := strconv.ParseFloat(data["__rank"].String, 64)
+		values := models.NewRecordFromNullStringMap(collection, data).PublicExport()
+		values["rank"] = rank
+		values["score"] = scorer.score(rank)
+
+		if csvWriter != nil {
+			line := make([]string, len(columns))
+			for i, column := range columns {
+				line[i] = csvValue(values[column])
+			}
+			if err := csvWriter.Write(line); err != nil {
+				return err
+			}
+		} else {
+			line := make(map[string]any, len(columns))
+			for _, column := range columns {
+				if value, ok := values[column]; ok {
+					line[column] = value
+				}
+			}
+			if err := jsonEncoder.Encode(line); err != nil {
+				return err
+			}
+		}
+
+		count++
+		if count%ExportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return nil
+}
+
+func exportColumns(collection *models.Collection) []string {
+	columns := []string{schema.FieldNameId}
+	if collection.IsAuth() {
+		columns = append(columns,
+			schema.FieldNameUsername,
+			schema.FieldNameEmail,
+			schema.FieldNameEmailVisibility,
+			schema.FieldNameVerified,
+		)
+	}
+	for _, field := range collection.Schema.Fields() {
+		columns = append(columns, field.Name)
+	}
+	if !collection.IsView() {
+		columns = append(columns, schema.FieldNameCreated, schema.FieldNameUpdated)
+	}
+	return append(columns, "rank", "score")
+}
+
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(raw)
+}
@@ -0,0 +1,84 @@
+package full_text_search
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+)
+
+func TestExport(t *testing.T) {
+	app := newPostsApp(t)
+	router := serve(t, app)
+	admin := adminToken(t, app)
+
+	tests := []struct {
+		name        string
+		query       string
+		status      int
+		contentType string
+		disposition string
+		lines       []string
+	}{
+		{
+			name:        "csv",
+			query:       "search=hello&format=csv&fields=title,org",
+			status:      200,
+			contentType: "text/csv; charset=utf-8",
+			disposition: `attachment; filename="posts.csv"`,
+			lines:       []string{"title,org", "hello one,o1", "hello two,o2"},
+		},
+		{
+			name:        "ndjson",
+			query:       "search=one&format=ndjson&fields=title",
+			status:      200,
+			contentType: "application/x-ndjson",
+			disposition: `attachment; filename="posts.ndjson"`,
+			lines:       []string{`{"title":"hello one"}`},
+		},
+		{
+			name:        "unknown field",
+			query:       "search=hello&format=csv&fields=title,secret",
+			status:      400,
+			contentType: "application/json",
+		},
+		{
+			name:        "invalid query",
+			query:       "search=%22hello&format=csv",
+			status:      400,
+			contentType: "application/json",
+		},
+		{
+			name:        "unsupported format",
+			query:       "search=hello&format=xml",
+			status:      400,
+			contentType: "application/json",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/collections/posts/records/full-text-search?"+test.query, nil)
+			req.Header.Set("Authorization", admin)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if contentType := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(contentType, test.contentType) {
+				t.Errorf("got content type %q, want %q", contentType, test.contentType)
+			}
+			if disposition := rec.Header().Get(echo.HeaderContentDisposition); disposition != test.disposition {
+				t.Errorf("got content disposition %q, want %q", disposition, test.disposition)
+			}
+			if test.lines == nil {
+				return
+			}
+			// The rows of equal rank come in any order, after the CSV header.
+			lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+			if lines[0] != test.lines[0] || !equalSets(lines, test.lines) {
+				t.Errorf("got %q, want %q", lines, test.lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package full_text_search
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// FacetLimit is the maximum number of values returned per facet, the most
+// frequent first.
+var FacetLimit = 100
+
+type FacetCount struct {
+	Value string `db:"value" json:"value"`
+	Count int    `db:"count" json:"count"`
+}
+
+// facetFields checks that every facet is a select or relation field.
+func facetFields(collection *models.Collection, facets []string) ([]*schema.SchemaField, error) {
+	fields := []*schema.SchemaField{}
+	for _, name := range facets {
+		field := collection.Schema.GetFieldByName(name)
+		if field == nil || (field.Type != schema.FieldTypeSelect && field.Type != schema.FieldTypeRelation) {
+			return nil, apis.NewBadRequestError("Invalid facet "+name+", only select and relation fields can be faceted.", nil)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// facetCounts counts the matching records per value of a field, over the
+// whole match set. Multiple values are expanded with json_each, so a record
+// counts once for each of its values.
+func facetCounts(query *dbx.SelectQuery, collection *models.Collection, field *schema.SchemaField) *dbx.Query {
+	column := "[[" + collection.Name + "." + field.Name + "]]"
+	value := column
+	if options, ok := field.Options.(schema.MultiValuer); ok && options.IsMultiple() {
+		query.InnerJoin("json_each(CASE WHEN json_valid("+column+") THEN "+column+" ELSE json_array("+column+") END) __facet", nil)
+		value = "[[__facet.value]]"
+	}
+	return query.
+		Distinct(false).
+		Select(value+" AS value", "COUNT(DISTINCT [["+collection.Name+".id]]) AS count").
+		AndWhere(dbx.NewExp(value+" != ''")).
+		GroupBy("value").
+		OrderBy("count DESC", "value ASC").
+		Limit(int64(FacetLimit)).
+		Build()
+}
+
+// searchFacets returns the facet counts and the queries that computed them.
+func searchFacets(app *pocketbase.PocketBase, collection *models.Collection, match *ftsMatch, options SearchOptions, scorer *scorer) (map[string][]*FacetCount, []*dbx.Query, error) {
+	facets := map[string][]*FacetCount{}
+	queries := []*dbx.Query{}
+	fields, err := facetFields(collection, options.Facets)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, field := range fields {
+		query, err := matchQuery(app, collection, match, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts := facetCounts(scorer.filter(collection, query, options), collection, field)
+		items := []*FacetCount{}
+		if err := counts.All(&items); err != nil {
+			return nil, nil, err
+		}
+		facets[field.Name] = items
+		queries = append(queries, counts)
+	}
+	return facets, queries, nil
+}
@@ -0,0 +1,251 @@
+package full_text_search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+)
+
+var (
+	// FuzzyMaxDistance caps the edit distance of expanded terms. Shorter
+	// words get a smaller budget (one edit per four characters).
+	FuzzyMaxDistance = 2
+	// FuzzyMaxExpansions caps how many vocabulary terms a word expands to.
+	FuzzyMaxExpansions = 10
+)
+
+// fuzzyQuery expands the bare terms of q into OR groups of indexed terms
+// within edit distance, and also returns q itself as the exact query so that
+// exact hits can be ranked first. Operators, phrases, prefix terms, column
+// filters and NEAR groups are kept as they are.
+func fuzzyQuery(app *pocketbase.PocketBase, fts string, q string) (string, string, error) {
+	tokens := queryTokens(q)
+	var b strings.Builder
+	// operand is whether the previous token ended an operand. FTS5 only
+	// joins phrases implicitly, so an explicit AND goes before a group.
+	operand := false
+	write := func(token queryToken, starts bool, ends bool) {
+		if starts && operand {
+			b.WriteString(" AND")
+		}
+		b.WriteString(token.space + token.text)
+		operand = ends
+	}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token.kind == tokenPhrase:
+			write(token, true, true)
+		case token.kind == tokenWord && token.text == "NEAR" && nextToken(tokens, i) == "(":
+			// NEAR only accepts phrases, keep the whole group.
+			write(token, true, false)
+			for i++; i < len(tokens); i++ {
+				b.WriteString(tokens[i].space + tokens[i].text)
+				if tokens[i].text == ")" {
+					break
+				}
+			}
+			operand = true
+		case token.kind == tokenWord && (token.text == "AND" || token.text == "OR" || token.text == "NOT"):
+			write(token, false, false)
+		case token.kind == tokenWord && nextToken(tokens, i) == ":":
+			// A column filter.
+			write(token, true, false)
+		case token.kind == tokenWord:
+			words := queryWords(token.text)
+			if len(words) != 1 || nextToken(tokens, i) == "*" || nextToken(tokens, i) == "+" ||
+				previousToken(tokens, i) == "^" || previousToken(tokens, i) == "+" {
+				write(token, true, true)
+				continue
+			}
+			terms, err := fuzzyTerms(app, fts, words[0])
+			if err != nil {
+				return "", "", err
+			}
+			if len(terms) > 1 {
+				token.text = "(" + strings.Join(surround(terms, "\"", "\""), " OR ") + ")"
+			}
+			write(token, true, true)
+		case token.text == "{":
+			write(token, true, false)
+			for i++; i < len(tokens); i++ {
+				b.WriteString(tokens[i].space + tokens[i].text)
+				if tokens[i].text == "}" {
+					break
+				}
+			}
+		case token.text == "(" || token.text == "^" || token.text == "-":
+			write(token, true, false)
+		case token.text == ")" || token.text == "*":
+			write(token, false, true)
+		default:
+			write(token, false, false)
+		}
+	}
+	return b.String(), q, nil
+}
+
+func fuzzyTerms(app *pocketbase.PocketBase, fts string, word string) ([]string, error) {
+	length := len([]rune(word))
+	maxDistance := min(FuzzyMaxDistance, length/4)
+	if maxDistance == 0 {
+		return []string{word}, nil
+	}
+
+	type Term struct {
+		Term string `db:"term"`
+		Doc  int    `db:"doc"`
+	}
+	items := []*Term{}
+	err := app.Dao().DB().
+		NewQuery("SELECT term, doc FROM " + fts + "_vocab WHERE length(term) BETWEEN {:min} AND {:max};").
+		Bind(dbx.Params{
+			"min": length - maxDistance,
+			"max": length + maxDistance,
+		}).
+		All(&items)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		term     string
+		doc      int
+		distance int
+	}
+	candidates := []candidate{}
+	for _, item := range items {
+		if item.Term == word {
+			continue
+		}
+		distance := editDistance(word, item.Term)
+		if distance <= maxDistance {
+			candidates = append(candidates, candidate{item.Term, item.Doc, distance})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].doc > candidates[j].doc
+	})
+
+	terms := []string{word}
+	for i := 0; i < len(candidates) && i < FuzzyMaxExpansions; i++ {
+		terms = append(terms, candidates[i].term)
+	}
+	return terms, nil
+}
+
+const (
+	tokenWord = iota
+	tokenPhrase
+	tokenPunct
+)
+
+// queryToken is a bareword, a quoted phrase or a single punctuation
+// character of an FTS5 query, with the whitespace before it.
+type queryToken struct {
+	kind  int
+	text  string
+	space string
+}
+
+// queryTokens splits q the same way the FTS5 query parser does.
+func queryTokens(q string) []queryToken {
+	tokens := []queryToken{}
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		start := i
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+		if i == len(runes) {
+			break
+		}
+		token := queryToken{space: string(runes[start:i])}
+		start = i
+		switch {
+		case runes[i] == '"':
+			token.kind = tokenPhrase
+			for i++; i < len(runes); i++ {
+				if runes[i] == '"' {
+					if i+1 < len(runes) && runes[i+1] == '"' {
+						i++
+						continue
+					}
+					i++
+					break
+				}
+			}
+		case isBareword(runes[i]):
+			token.kind = tokenWord
+			for i < len(runes) && isBareword(runes[i]) {
+				i++
+			}
+		default:
+			token.kind = tokenPunct
+			i++
+		}
+		token.text = string(runes[start:i])
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func isBareword(r rune) bool {
+	return r >= 0x80 || r == '_' || r == 0x1a ||
+		(r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func nextToken(tokens []queryToken, i int) string {
+	if i+1 < len(tokens) {
+		return tokens[i+1].text
+	}
+	return ""
+}
+
+func previousToken(tokens []queryToken, i int) string {
+	if i > 0 {
+		return tokens[i-1].text
+	}
+	return ""
+}
+
+// queryWords splits q the same way the unicode61 tokenizer does.
+func queryWords(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// editDistance is the optimal string alignment distance, so that a swap of
+// two adjacent characters ("recieve") counts as a single edit.
+func editDistance(a string, b string) int {
+	s := []rune(a)
+	t := []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
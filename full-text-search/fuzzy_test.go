@@ -0,0 +1,98 @@
+package full_text_search
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"hello", "hello", 0},
+		{"hello", "", 5},
+		{"", "hello", 5},
+		{"hello", "hallo", 1},
+		{"hello", "hell", 1},
+		{"hello", "helloo", 1},
+		{"receive", "recieve", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+		{"über", "uber", 1},
+		{"日本語", "日本", 1},
+	}
+	for _, test := range tests {
+		if distance := editDistance(test.a, test.b); distance != test.distance {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, distance, test.distance)
+		}
+	}
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.ResetBootstrapState()
+
+	db := app.Dao().DB()
+	if _, err := db.NewQuery("CREATE VIRTUAL TABLE posts_fts USING FTS5 (title, content);").Execute(); err != nil {
+		t.Skip("FTS5 is not available, run the tests with -tags fts5:", err)
+	}
+	for _, sql := range []string{
+		"CREATE VIRTUAL TABLE posts_fts_vocab USING fts5vocab(posts_fts, row);",
+		"INSERT INTO posts_fts (title, content) VALUES ('pocketbase', 'hello world'), ('pocketbose', 'hallo welt');",
+	} {
+		if _, err := db.NewQuery(sql).Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		q     string
+		match string
+	}{
+		{"hello", `("hello" OR "hallo")`},
+		{"Hello", `("hello" OR "hallo")`},
+		{"pocketbase hello", `("pocketbase" OR "pocketbose") AND ("hello" OR "hallo")`},
+		{"pocketbase OR hello", `("pocketbase" OR "pocketbose") OR ("hello" OR "hallo")`},
+		{"pocketbase NOT hello", `("pocketbase" OR "pocketbose") NOT ("hello" OR "hallo")`},
+		{"(pocketbase OR hello) world", `(("pocketbase" OR "pocketbose") OR ("hello" OR "hallo")) AND world`},
+		{`"hello world" pocketbase`, `"hello world" AND ("pocketbase" OR "pocketbose")`},
+		{"hel* pocketbase", `hel* AND ("pocketbase" OR "pocketbose")`},
+		{"title : pocketbase", `title : ("pocketbase" OR "pocketbose")`},
+		{"{title content}: hello", `{title content}: ("hello" OR "hallo")`},
+		{"- content : hello", `- content : ("hello" OR "hallo")`},
+		{"^hello", "^hello"},
+		{"hello + world", "hello + world"},
+		{"NEAR(hello world, 2) pocketbase", `NEAR(hello world, 2) AND ("pocketbase" OR "pocketbose")`},
+		{"world", "world"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		match, exact, err := fuzzyQuery(app, "posts_fts", test.q)
+		if err != nil {
+			t.Errorf("fuzzyQuery(%q) failed: %v", test.q, err)
+			continue
+		}
+		if match != test.match {
+			t.Errorf("fuzzyQuery(%q) = %s, want %s", test.q, match, test.match)
+		}
+		if exact != test.q {
+			t.Errorf("fuzzyQuery(%q) exact = %s, want the query itself", test.q, exact)
+		}
+		if match == "" {
+			continue
+		}
+		count := 0
+		err = db.NewQuery("SELECT COUNT(*) FROM posts_fts WHERE posts_fts MATCH {:match};").
+			Bind(map[string]any{"match": match}).
+			Row(&count)
+		if err != nil {
+			t.Errorf("fuzzyQuery(%q) = %s is not a valid FTS5 query: %v", test.q, match, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package full_text_search
+
+import (
+	"errors"
+
+	"github.com/dop251/goja"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// JsSearchOptions are the options of $fts.search. Searches are limited by
+// the ListRule and tenant of the request, unless Unrestricted is set.
+type JsSearchOptions struct {
+	Page     int
+	PerPage  int
+	Fuzzy    bool
+	Fields   []string
+	Debug    bool
+	MinScore float64
+	Tenants  []string
+	Language string
+	Facets   []string
+	// Unrestricted searches all the records, eg. from cron jobs. Without it
+	// a request context is required.
+	Unrestricted bool
+}
+
+// BindJsvm registers the $fts global in a pb_hooks runtime:
+//
+//	$fts.search(c, "posts", "hello", { page: 1, perPage: 10 })
+//	$fts.search(null, "posts", "hello", { unrestricted: true })
+//	$fts.rebuild("posts")
+func BindJsvm(app *pocketbase.PocketBase, vm *goja.Runtime, collections ...string) {
+	obj := vm.NewObject()
+	vm.Set("$fts", obj)
+
+	obj.Set("search", func(c echo.Context, target string, q string, jsOptions JsSearchOptions) (*SearchResult, error) {
+		collection, err := findIndexedCollection(app, target, collections...)
+		if err != nil {
+			return nil, err
+		}
+		options := SearchOptions{
+			Page:     jsOptions.Page,
+			PerPage:  jsOptions.PerPage,
+			Fuzzy:    jsOptions.Fuzzy,
+			Fields:   jsOptions.Fields,
+			Debug:    jsOptions.Debug,
+			MinScore: jsOptions.MinScore,
+			Tenants:  jsOptions.Tenants,
+			Language: jsOptions.Language,
+			Facets:   jsOptions.Facets,
+		}
+		if !jsOptions.Unrestricted {
+			if c == nil {
+				return nil, errors.New("$fts.search needs the request context, or the unrestricted option")
+			}
+			options.RequestInfo = apis.RequestInfo(c)
+			if options.Debug && options.RequestInfo.Admin == nil {
+				return nil, apis.NewForbiddenError("Only admins can debug search queries.", nil)
+			}
+		}
+		return Search(app, collection.Name, q, options)
+	})
+
+	obj.Set("rebuild", func(target string) error {
+		collection, err := findIndexedCollection(app, target, collections...)
+		if err != nil {
+			return err
+		}
+		return Rebuild(app, collection.Name)
+	})
+}
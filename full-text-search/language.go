@@ -0,0 +1,145 @@
+package full_text_search
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Collections with a LanguageField get one extra index per configured
+// language, named <name>_fts_<language>, that only holds the records of that
+// language and uses its tokenizer. The <name>_fts index keeps all records.
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+type ftsIndex struct {
+	table     string
+	language  string
+	tokenizer string
+}
+
+// collectionIndexes are the FTS5 tables of a collection, starting with the
+// one of all languages.
+func collectionIndexes(target string) []ftsIndex {
+	indexes := []ftsIndex{{table: target + "_fts"}}
+	config := CollectionConfigs[target]
+	if config.LanguageField == "" {
+		return indexes
+	}
+	languages := []string{}
+	for language := range config.Languages {
+		if languagePattern.MatchString(language) {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		indexes = append(indexes, ftsIndex{
+			table:     target + "_fts_" + language,
+			language:  language,
+			tokenizer: config.Languages[language],
+		})
+	}
+	return indexes
+}
+
+// where limits a statement to the records of the index language.
+func (index ftsIndex) where(collection *models.Collection, prefix string) string {
+	if index.language == "" {
+		return ""
+	}
+	field := CollectionConfigs[collection.Name].LanguageField
+	return " WHERE " + prefix + field + " = '" + index.language + "'"
+}
+
+// ftsTable is the FTS5 table to search for the language, or the one of all
+// languages when no language is given or it has no index of its own.
+func ftsTable(collection *models.Collection, language string) string {
+	language = primarySubtag(language)
+	for _, index := range collectionIndexes(collection.Name) {
+		if language != "" && index.language == language {
+			return index.table
+		}
+	}
+	return collection.Name + "_fts"
+}
+
+// requestLanguage reads the lang query param, or else picks the first
+// Accept-Language entry that has its own index.
+func requestLanguage(c echo.Context, collection *models.Collection) string {
+	if lang := c.QueryParam("lang"); lang != "" {
+		return primarySubtag(lang)
+	}
+	indexes := collectionIndexes(collection.Name)
+	for _, entry := range strings.Split(c.Request().Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(entry, ";")
+		primary := primarySubtag(tag)
+		for _, index := range indexes {
+			if index.language != "" && index.language == primary {
+				return primary
+			}
+		}
+	}
+	return ""
+}
+
+// primarySubtag is the lowercase language of a tag, eg. "en" for "en-US".
+func primarySubtag(tag string) string {
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	return strings.ToLower(primary)
+}
+
+func createLanguageFts(app *pocketbase.PocketBase, collection *models.Collection, fields []string, content string) error {
+	for language := range CollectionConfigs[collection.Name].Languages {
+		if !languagePattern.MatchString(language) {
+			return fmt.Errorf("invalid language %q, expected a lowercase ISO 639 code", language)
+		}
+	}
+	for _, index := range collectionIndexes(collection.Name)[1:] {
+		exists, _ := checkIfTableExists(app, index.table)
+		if exists {
+			continue
+		}
+		var stmt strings.Builder
+		stmt.WriteString("CREATE VIRTUAL TABLE " + index.table + " USING FTS5 (")
+		stmt.WriteString("  " + strings.Join(columnDefs(collection, fields), ", ") + ",")
+		stmt.WriteString("  content=" + content)
+		if index.tokenizer != "" {
+			stmt.WriteString(",  tokenize='" + strings.ReplaceAll(index.tokenizer, "'", "''") + "'")
+		}
+		stmt.WriteString(");")
+		app.Logger().Info(stmt.String())
+		if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLanguageFts repopulates the language indexes, since the rebuild
+// command would add every record of the content table to them.
+func syncLanguageFts(app *pocketbase.PocketBase, collection *models.Collection, fields []string) error {
+	tbl := "`" + collection.Name + "`"
+	for _, index := range collectionIndexes(collection.Name)[1:] {
+		stmts := []string{
+			"INSERT INTO " + index.table + "(" + index.table + ") VALUES('delete-all');",
+			"INSERT INTO " + index.table + "(rowid, " + strings.Join(fields, ", ") + ") " +
+				"SELECT rowid, " + strings.Join(sourceValues(collection, fields, ""), ", ") + " " +
+				"FROM " + tbl + index.where(collection, "") + ";",
+		}
+		for _, stmt := range stmts {
+			app.Logger().Info(stmt)
+			if _, err := app.Dao().DB().NewQuery(stmt).Execute(); err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package full_text_search
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func TestLanguageIndex(t *testing.T) {
+	posts := &models.Collection{Name: "posts"}
+	notes := &models.Collection{Name: "notes"}
+	setConfig(t, "posts", CollectionConfig{
+		LanguageField: "lang",
+		Languages:     map[string]string{"en": "porter unicode61", "de": "unicode61"},
+	})
+
+	tests := []struct {
+		name           string
+		collection     *models.Collection
+		lang           string
+		acceptLanguage string
+		table          string
+	}{
+		{"no language", posts, "", "", "posts_fts"},
+		{"lang", posts, "de", "", "posts_fts_de"},
+		{"lang with a region", posts, "en-US", "", "posts_fts_en"},
+		{"uppercase lang", posts, "EN", "", "posts_fts_en"},
+		{"lang without an index", posts, "fr", "", "posts_fts"},
+		{"lang wins over the header", posts, "de", "en", "posts_fts_de"},
+		{"first header entry with an index", posts, "", "fr-FR, en-GB;q=0.8, de;q=0.5", "posts_fts_en"},
+		{"header without an index", posts, "", "fr-FR", "posts_fts"},
+		{"collection without languages", notes, "en", "", "notes_fts"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/?lang="+test.lang, nil)
+			req.Header.Set("Accept-Language", test.acceptLanguage)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			if table := ftsTable(test.collection, requestLanguage(c, test.collection)); table != test.table {
+				t.Errorf("got %s, want %s", table, test.table)
+			}
+		})
+	}
+}
@@ -2,6 +2,10 @@ package full_text_search
 
 import (
 	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/labstack/echo/v5"
@@ -10,8 +14,33 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
 )
 
+type CollectionConfig struct {
+	// RefreshSchedule is the cron expression used to rebuild the index of a
+	// view collection. Base collections are kept in sync by triggers.
+	RefreshSchedule string
+	// TenantField is stored as an UNINDEXED column, and searches by users
+	// only return the records whose tenant matches their own. Indexes built
+	// with another tenant field, or none, are rebuilt at startup.
+	TenantField string
+	// AuthTenantField is the field of the auth record that holds the
+	// tenant of the user. Defaults to TenantField. Both fields are checked
+	// when the index is created at startup.
+	AuthTenantField string
+	// LanguageField routes every record to the index of its language, in
+	// addition to the index of all languages.
+	LanguageField string
+	// Languages maps the ISO 639 code of each language to its FTS5
+	// tokenizer, eg. "porter unicode61".
+	Languages map[string]string
+}
+
+var CollectionConfigs = map[string]CollectionConfig{}
+
+var DefaultRefreshSchedule = "*/15 * * * *"
+
 // https://www.sqlite.org/fts5.html#external_content_tables
 func Init(app *pocketbase.PocketBase, collections ...string) error {
 	app.OnCollectionAfterCreateRequest().Add(func(e *core.CollectionCreateEvent) error {
@@ -69,78 +98,190 @@ func Init(app *pocketbase.PocketBase, collections ...string) error {
 		}
 		return nil
 	})
+	scheduleViewRefresh(app, collections...)
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		group := e.Router.Group("/api/collections/:collectionIdOrName/records", apis.ActivityLogger(app))
 		group.GET("/full-text-search", func(c echo.Context) error {
 			target := c.PathParam("collectionIdOrName")
-			if _, err := app.Dao().FindCollectionByNameOrId(target); err != nil {
+			collection, err := findIndexedCollection(app, target, collections...)
+			if err != nil {
 				app.Logger().Error(fmt.Sprint(err))
 				return err
 			}
-			tbl := target // collection.TableName()
 			q := c.QueryParam("search")
 			if q == "" {
 				return c.NoContent(204)
 			}
-			var query strings.Builder
-			query.WriteString("SELECT * ") // rank as '@rank'
-			query.WriteString("FROM " + tbl + "_fts ")
-			// query.WriteString("INNER JOIN " + tbl + " tbl ON tbl.id = " + tbl + "_fts._id ")
-			query.WriteString("WHERE " + tbl + "_fts MATCH {:q} ")
-			query.WriteString("ORDER BY rank;")
-
-			results := []dbx.NullStringMap{}
-			err := app.Dao().DB().
-				NewQuery(query.String()).
-				Bind(dbx.Params{"q": q}).
-				All(&results)
-			if err != nil {
-				app.Logger().Error(fmt.Sprint(err))
-				return err
+
+			options := SearchOptions{
+				RequestInfo: apis.RequestInfo(c),
+			}
+			if page := c.QueryParam("page"); page != "" {
+				if options.Page, err = strconv.Atoi(page); err != nil {
+					return apis.NewBadRequestError("Invalid page, it must be a number.", err)
+				}
+			}
+			if perPage := c.QueryParam("perPage"); perPage != "" {
+				if options.PerPage, err = strconv.Atoi(perPage); err != nil {
+					return apis.NewBadRequestError("Invalid perPage, it must be a number.", err)
+				}
+			}
+			if fuzzy := c.QueryParam("fuzzy"); fuzzy != "" {
+				if options.Fuzzy, err = strconv.ParseBool(fuzzy); err != nil {
+					return apis.NewBadRequestError("Invalid fuzzy, it must be true or false.", err)
+				}
 			}
-			app.Logger().Info(fmt.Sprint(results))
-
-			c.Response().Header().Set(echo.HeaderContentType, "application/json")
-			items := []map[string]any{}
-			for _, result := range results {
-				m := make(map[string]interface{})
-				for key := range result {
-					val := result[key]
-					value, err := val.Value()
-					if err != nil || !val.Valid {
-						m[key] = nil
-					} else {
-						m[key] = value
+			if in := c.QueryParam("in"); in != "" {
+				options.Fields = strings.Split(in, ",")
+			}
+			if minScore := c.QueryParam("minScore"); minScore != "" {
+				options.MinScore, err = strconv.ParseFloat(minScore, 64)
+				if err != nil || math.IsNaN(options.MinScore) {
+					return apis.NewBadRequestError("Invalid minScore, it must be a number.", err)
+				}
+			}
+			options.Language = requestLanguage(c, collection)
+			if facets := c.QueryParam("facets"); facets != "" {
+				options.Facets = strings.Split(facets, ",")
+			}
+			if debug := c.QueryParam("debug"); debug != "" {
+				if options.Debug, err = strconv.ParseBool(debug); err != nil {
+					return apis.NewBadRequestError("Invalid debug, it must be true or false.", err)
+				}
+			}
+			if options.Debug && options.RequestInfo.Admin == nil {
+				return apis.NewForbiddenError("Only admins can debug search queries.", nil)
+			}
+
+			if format := c.QueryParam("format"); format != "" {
+				export := ExportOptions{Format: format}
+				if columns := c.QueryParam("fields"); columns != "" {
+					for _, column := range strings.Split(columns, ",") {
+						export.Columns = append(export.Columns, strings.TrimSpace(column))
+					}
+				}
+				switch format {
+				case FormatCSV:
+					c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+				case FormatNDJSON:
+					c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+				default:
+					return apis.NewBadRequestError("Unsupported export format.", nil)
+				}
+				c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+collection.Name+"."+format+"\"")
+
+				err := Export(app, collection.Name, q, options, export, c.Response())
+				if err != nil {
+					app.Logger().Error(fmt.Sprint(err))
+					if c.Response().Committed {
+						return nil
 					}
+					// Nothing was written yet, so the error isn't
+					// downloaded as the export file.
+					c.Response().Header().Del(echo.HeaderContentType)
+					c.Response().Header().Del(echo.HeaderContentDisposition)
+					return searchError(err)
 				}
-				items = append(items, m)
+				return nil
 			}
 
-			// TODO: Paging result
-			return c.JSON(200, items)
+			result, err := Search(app, collection.Name, q, options)
+			if err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return searchError(err)
+			}
+
+			return c.JSON(200, result)
 
 		})
+		group.POST("/full-text-search/refresh", func(c echo.Context) error {
+			target := c.PathParam("collectionIdOrName")
+			collection, err := findIndexedCollection(app, target, collections...)
+			if err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+			if err := Rebuild(app, collection.Name); err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+			return c.NoContent(204)
+		}, apis.RequireAdminAuth())
 		return nil
 	})
 
 	return nil
 }
 
+func searchError(err error) error {
+	if apiErr, ok := err.(*apis.ApiError); ok {
+		return apiErr
+	}
+	return apis.NewBadRequestError("Invalid search query.", err)
+}
+
 func createCollectionFts(app *pocketbase.PocketBase, target string) error {
 	collection, err := app.Dao().FindCollectionByNameOrId(target)
 	if err != nil {
 		app.Logger().Error(fmt.Sprint(err))
 		return err
 	}
+	if err := checkTenantFields(app, collection); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
 	fields := collectionFields(collection, "id")
+	stale, err := staleFts(app, collection, fields)
+	if err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
+	if stale {
+		// Indexes created before a field or TenantField was added, whose
+		// columns don't match the triggers anymore.
+		app.Logger().Info("rebuilding the full text search indexes of " + target)
+		if err := deleteCollection(app, target); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+	}
 	exists, _ := checkIfTableExists(app, target+"_fts")
 
-	if !exists {
-		tbl := "`" + target + "`"
+	content := target
+	if collection.IsView() {
+		content = "''"
+	} else if collection.IsAuth() {
+		content = target + "_fts_source, content_rowid=_rowid"
+	}
+
+	if !exists && collection.IsView() {
+		if err := createViewFts(app, collection, fields); err != nil {
+			return err
+		}
+	} else if !exists {
+		if collection.IsAuth() {
+			// Auth records are indexed through a view that blanks hidden
+			// emails, so they can't be matched or leak through snippets.
+			var stmt strings.Builder
+			stmt.WriteString("CREATE VIEW IF NOT EXISTS " + target + "_fts_source AS ")
+			stmt.WriteString("SELECT rowid AS _rowid, ")
+			values := sourceValues(collection, fields, "")
+			for i := range values {
+				values[i] += " AS " + fields[i]
+			}
+			stmt.WriteString(strings.Join(values, ", "))
+			stmt.WriteString(" FROM `" + target + "`;")
+			app.Logger().Info(stmt.String())
+			if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+		}
+
 		var stmt strings.Builder
 		stmt.WriteString("CREATE VIRTUAL TABLE " + target + "_fts USING FTS5 (")
-		stmt.WriteString("  " + strings.Join(fields, ", ") + ",")
-		stmt.WriteString("  content=" + target + ",")
+		stmt.WriteString("  " + strings.Join(columnDefs(collection, fields), ", ") + ",")
+		stmt.WriteString("  content=" + content)
 		// stmt.WriteString("  content=''")
 		// stmt.WriteString("  content_rowid='id'")
 		stmt.WriteString(");")
@@ -149,11 +290,60 @@ func createCollectionFts(app *pocketbase.PocketBase, target string) error {
 			app.Logger().Error(fmt.Sprint(err))
 			return err
 		}
+	}
 
-		stmt.Reset()
-		stmt.WriteString("CREATE TRIGGER  " + target + "_fts_insert AFTER INSERT ON " + tbl + " BEGIN ")
-		stmt.WriteString("  INSERT INTO " + target + "_fts(" + strings.Join(fields, ", ") + ")")
-		stmt.WriteString("  VALUES (" + strings.Join(surround(fields, "new.", ""), ", ") + ");")
+	if err := createLanguageFts(app, collection, fields, content); err != nil {
+		return err
+	}
+
+	if !collection.IsView() {
+		if err := createCollectionTriggers(app, collection, fields); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range collectionIndexes(target) {
+		stmt := "CREATE VIRTUAL TABLE IF NOT EXISTS " + index.table + "_vocab USING fts5vocab(" + index.table + ", 'row');"
+		app.Logger().Info(stmt)
+		if _, err := app.Dao().DB().NewQuery(stmt).Execute(); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+	}
+
+	err = syncCollection(app, target)
+	if err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
+
+	return nil
+}
+
+// createCollectionTriggers (re)creates the triggers that keep the external
+// content indexes in sync, keyed by the rowid of the records table.
+func createCollectionTriggers(app *pocketbase.PocketBase, collection *models.Collection, fields []string) error {
+	tbl := "`" + collection.Name + "`"
+	columns := "rowid, " + strings.Join(fields, ", ")
+	newValues := "new.rowid, " + strings.Join(sourceValues(collection, fields, "new."), ", ")
+	oldValues := "old.rowid, " + strings.Join(sourceValues(collection, fields, "old."), ", ")
+
+	for _, index := range collectionIndexes(collection.Name) {
+		fts := index.table
+		insertNew := "INSERT INTO " + fts + "(" + columns + ") SELECT " + newValues + index.where(collection, "new.") + ";"
+		deleteOld := "INSERT INTO " + fts + "(" + fts + ", " + columns + ") SELECT 'delete', " + oldValues + index.where(collection, "old.") + ";"
+
+		for _, trigger := range []string{"insert", "update", "delete"} {
+			stmt := "DROP TRIGGER IF EXISTS " + fts + "_" + trigger + ";"
+			if _, err := app.Dao().DB().NewQuery(stmt).Execute(); err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+		}
+
+		var stmt strings.Builder
+		stmt.WriteString("CREATE TRIGGER  " + fts + "_insert AFTER INSERT ON " + tbl + " BEGIN ")
+		stmt.WriteString("  " + insertNew)
 		stmt.WriteString("END;")
 		app.Logger().Info(stmt.String())
 		if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
@@ -162,11 +352,9 @@ func createCollectionFts(app *pocketbase.PocketBase, target string) error {
 		}
 
 		stmt.Reset()
-		stmt.WriteString("CREATE TRIGGER  " + target + "_fts_update AFTER UPDATE ON " + tbl + " BEGIN ")
-		stmt.WriteString("  INSERT INTO " + target + "_fts(" + target + "_fts, " + strings.Join(fields, ", ") + ")")
-		stmt.WriteString("  VALUES ('delete', " + strings.Join(surround(fields, "old.", ""), ", ") + ");")
-		stmt.WriteString("  INSERT INTO " + target + "_fts(" + strings.Join(fields, ", ") + ")")
-		stmt.WriteString("  VALUES (" + strings.Join(surround(fields, "new.", ""), ", ") + ");")
+		stmt.WriteString("CREATE TRIGGER  " + fts + "_update AFTER UPDATE ON " + tbl + " BEGIN ")
+		stmt.WriteString("  " + deleteOld)
+		stmt.WriteString("  " + insertNew)
 		stmt.WriteString("END;")
 		app.Logger().Info(stmt.String())
 		if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
@@ -175,9 +363,8 @@ func createCollectionFts(app *pocketbase.PocketBase, target string) error {
 		}
 
 		stmt.Reset()
-		stmt.WriteString("CREATE TRIGGER  " + target + "_fts_delete AFTER DELETE ON " + tbl + " BEGIN ")
-		stmt.WriteString("  INSERT INTO " + target + "_fts(" + target + "_fts, " + strings.Join(fields, ", ") + ")")
-		stmt.WriteString("  VALUES ('delete', " + strings.Join(surround(fields, "old.", ""), ", ") + ");")
+		stmt.WriteString("CREATE TRIGGER  " + fts + "_delete AFTER DELETE ON " + tbl + " BEGIN ")
+		stmt.WriteString("  " + deleteOld)
 		stmt.WriteString("END;")
 		app.Logger().Info(stmt.String())
 		if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
@@ -186,29 +373,116 @@ func createCollectionFts(app *pocketbase.PocketBase, target string) error {
 		}
 	}
 
-	err = syncCollection(app, target)
-	if err != nil {
-		app.Logger().Error(fmt.Sprint(err))
-		return err
-	}
-
 	return nil
 }
 
 func deleteCollection(app *pocketbase.PocketBase, target string) error {
+	for _, index := range collectionIndexes(target) {
+		for _, trigger := range []string{"insert", "update", "delete"} {
+			if _, err := app.Dao().DB().
+				NewQuery("DROP TRIGGER IF EXISTS " + index.table + "_" + trigger + ";").
+				Execute(); err != nil {
+				return err
+			}
+		}
+		if _, err := app.Dao().DB().
+			NewQuery("DROP TABLE IF EXISTS " + index.table + "_vocab;").
+			Execute(); err != nil {
+			return err
+		}
+		if _, err := app.Dao().DB().
+			NewQuery("DROP TABLE IF EXISTS " + index.table + ";").
+			Execute(); err != nil {
+			return err
+		}
+	}
 	if _, err := app.Dao().DB().
-		NewQuery("DELETE FROM " + target + "_fts;").
+		NewQuery("DROP TABLE IF EXISTS " + target + "_fts_ids;").
 		Execute(); err != nil {
 		return err
 	}
 	if _, err := app.Dao().DB().
-		NewQuery("DROP TABLE IF EXISTS " + target + "_fts;").
+		NewQuery("DROP VIEW IF EXISTS " + target + "_fts_source;").
 		Execute(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// checkTenantFields checks that the TenantField of the collection and the
+// AuthTenantField exist, so that a typo fails at startup and not at every
+// search.
+func checkTenantFields(app *pocketbase.PocketBase, collection *models.Collection) error {
+	config := CollectionConfigs[collection.Name]
+	if config.TenantField != "" && !slices.Contains(collectionFields(collection, "id"), config.TenantField) {
+		return fmt.Errorf("%s has no tenant field %s", collection.Name, config.TenantField)
+	}
+	if config.AuthTenantField == "" {
+		return nil
+	}
+	if config.TenantField == "" {
+		return fmt.Errorf("%s has an AuthTenantField but no TenantField", collection.Name)
+	}
+	authCollections, err := app.Dao().FindCollectionsByType(models.CollectionTypeAuth)
+	if err != nil {
+		return err
+	}
+	for _, authCollection := range authCollections {
+		if slices.Contains(collectionFields(authCollection, "id"), config.AuthTenantField) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no auth collection has the tenant field %s of %s", config.AuthTenantField, collection.Name)
+}
+
+// staleFts reports whether an existing index of the collection has other
+// columns than the ones it should index.
+func staleFts(app *pocketbase.PocketBase, collection *models.Collection, fields []string) (bool, error) {
+	expected := columnDefs(collection, fields)
+	for _, index := range collectionIndexes(collection.Name) {
+		columns, err := ftsColumns(app, index.table)
+		if err != nil {
+			return false, err
+		}
+		if len(columns) > 0 && !slices.Equal(columns, expected) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ftsColumns are the column definitions of an FTS5 table, or none when it
+// doesn't exist. The names come from the table info, since the options of
+// the CREATE statement can hold commas, eg. prefix='2,3', and only the
+// UNINDEXED flags are read from the statement.
+func ftsColumns(app *pocketbase.PocketBase, table string) ([]string, error) {
+	names := []string{}
+	err := app.Dao().DB().
+		NewQuery("SELECT name FROM pragma_table_info({:table_name});").
+		Bind(dbx.Params{"table_name": table}).
+		Column(&names)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	stmt := ""
+	err = app.Dao().DB().
+		NewQuery("SELECT sql FROM sqlite_master WHERE type='table' AND name = {:table_name};").
+		Bind(dbx.Params{"table_name": table}).
+		Row(&stmt)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{}
+	for _, name := range names {
+		unindexed := regexp.MustCompile(`(?i)[(,]\s*` + regexp.QuoteMeta(name) + `\s+UNINDEXED\s*[,)]`)
+		if unindexed.MatchString(stmt) {
+			name += " UNINDEXED"
+		}
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
 func checkIfTableExists(app *pocketbase.PocketBase, target string) (bool, error) {
 	type Meta struct {
 		Name string `db:"name" json:"name"`
@@ -232,6 +506,19 @@ func checkIfTableExists(app *pocketbase.PocketBase, target string) (bool, error)
 }
 
 func syncCollection(app *pocketbase.PocketBase, target string) error {
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
+	if collection.IsView() {
+		if err := refreshViewFts(app, collection, collectionFields(collection, "id")); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		return nil
+	}
+
 	var stmt strings.Builder
 	stmt.WriteString("INSERT INTO " + target + "_fts(" + target + "_fts) VALUES('rebuild');")
 	// stmt.WriteString("INSERT INTO " + target + "_fts SELECT " + strings.Join(fields, ", ") + " FROM " + target)
@@ -241,11 +528,15 @@ func syncCollection(app *pocketbase.PocketBase, target string) error {
 		return err
 	}
 
-	return nil
+	return syncLanguageFts(app, collection, collectionFields(collection, "id"))
 }
 
 func collectionFields(collection *models.Collection, id string) []string {
 	fields := []string{id}
+	if collection.IsAuth() {
+		// tokenKey, passwordHash and the other auth columns are never indexed.
+		fields = append(fields, schema.FieldNameUsername, schema.FieldNameEmail)
+	}
 	for _, field := range collection.Schema.Fields() {
 		name := field.Name
 		fields = append(fields, name)
@@ -253,6 +544,33 @@ func collectionFields(collection *models.Collection, id string) []string {
 	return fields
 }
 
+func columnDefs(collection *models.Collection, fields []string) []string {
+	tenantField := CollectionConfigs[collection.Name].TenantField
+	defs := []string{}
+	for _, field := range fields {
+		if tenantField != "" && field == tenantField {
+			defs = append(defs, field+" UNINDEXED")
+		} else {
+			defs = append(defs, field)
+		}
+	}
+	return defs
+}
+
+// sourceValues are the expressions indexed for each field. Emails are only
+// indexed when the owner made them visible.
+func sourceValues(collection *models.Collection, fields []string, prefix string) []string {
+	values := []string{}
+	for _, field := range fields {
+		if collection.IsAuth() && field == schema.FieldNameEmail {
+			values = append(values, "CASE WHEN "+prefix+schema.FieldNameEmailVisibility+" THEN "+prefix+field+" ELSE '' END")
+		} else {
+			values = append(values, prefix+field)
+		}
+	}
+	return values
+}
+
 func surround(items []string, prefix string, suffix string) []string {
 	results := []string{}
 	for i := 0; i < len(items); i++ {
@@ -0,0 +1,214 @@
+package full_text_search
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/migrations/logs"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tokens"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+// newTestApp bootstraps an app with the system migrations in a temporary
+// directory. The tests that need it are skipped without FTS5.
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir(), HideStartBanner: true})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	if _, err := app.DB().NewQuery("CREATE VIRTUAL TABLE _fts5_check USING FTS5 (x);").Execute(); err != nil {
+		t.Skip("FTS5 is not available, run the tests with -tags fts5:", err)
+	}
+	if _, err := app.DB().NewQuery("DROP TABLE _fts5_check;").Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for db, list := range map[*dbx.DB]migrate.MigrationsList{
+		app.DB():     migrations.AppMigrations,
+		app.LogsDB(): logs.LogsMigrations,
+	} {
+		runner, err := migrate.NewRunner(db, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runner.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app
+}
+
+// serve runs the OnBeforeServe hooks like the serve command, and returns
+// the router with the routes of the plugin.
+func serve(t *testing.T, app *pocketbase.PocketBase) *echo.Echo {
+	t.Helper()
+	router, err := apis.InitApi(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.OnBeforeServe().Trigger(&core.ServeEvent{App: app, Router: router}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.OnTerminate().Trigger(&core.TerminateEvent{App: app}) })
+	return router
+}
+
+// setConfig sets the config of a collection for the duration of the test.
+func setConfig(t *testing.T, target string, config CollectionConfig) {
+	CollectionConfigs[target] = config
+	t.Cleanup(func() { delete(CollectionConfigs, target) })
+}
+
+func saveCollection(t *testing.T, app *pocketbase.PocketBase, collection *models.Collection) *models.Collection {
+	t.Helper()
+	if err := app.Dao().SaveCollection(collection); err != nil {
+		t.Fatal(err)
+	}
+	return collection
+}
+
+func saveRecord(t *testing.T, app *pocketbase.PocketBase, collection *models.Collection, values map[string]any) *models.Record {
+	t.Helper()
+	record := models.NewRecord(collection)
+	record.Load(values)
+	if collection.IsAuth() {
+		record.RefreshId()
+		record.RefreshTokenKey()
+		record.SetUsername("u" + record.Id)
+		record.SetPassword("1234567890")
+	}
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func adminToken(t *testing.T, app *pocketbase.PocketBase) string {
+	t.Helper()
+	admin := &models.Admin{Email: "admin@example.com"}
+	admin.SetPassword("1234567890")
+	if err := app.Dao().SaveAdmin(admin); err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.NewAdminAuthToken(app, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func recordToken(t *testing.T, app *pocketbase.PocketBase, record *models.Record) string {
+	t.Helper()
+	token, err := tokens.NewRecordAuthToken(app, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// request sends a request to the router and returns the status and the
+// JSON body, nil when the body isn't a JSON object.
+func request(router *echo.Echo, method string, url string, token string) (int, map[string]any) {
+	req := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	body := map[string]any{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		body = nil
+	}
+	return rec.Code, body
+}
+
+func TestStaleFts(t *testing.T) {
+	tests := []struct {
+		name   string
+		create string
+		stale  bool
+	}{
+		{"same columns", "id, title, org UNINDEXED, content='posts'", false},
+		{"multi-value option", "id, title, org UNINDEXED, prefix='2,3', content='posts'", false},
+		{"lowercase unindexed", "id, title, org unindexed, prefix = '2, 3'", false},
+		{"new field", "id, title, prefix='2,3'", true},
+		{"tenant field indexed", "id, title, org, prefix='2,3'", true},
+		{"other tenant field", "id, title UNINDEXED, org, content='posts'", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newPostsApp(t)
+			posts, _ := app.Dao().FindCollectionByNameOrId("posts")
+			if _, err := app.DB().NewQuery("CREATE VIRTUAL TABLE posts_fts USING FTS5 (" + test.create + ");").Execute(); err != nil {
+				t.Fatal(err)
+			}
+			stale, err := staleFts(app, posts, collectionFields(posts, "id"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stale != test.stale {
+				t.Errorf("got stale %v, want %v", stale, test.stale)
+			}
+		})
+	}
+}
+
+func TestEndpointAuth(t *testing.T) {
+	app := newPostsApp(t)
+	router := serve(t, app)
+
+	users, _ := app.Dao().FindCollectionByNameOrId("users")
+	user := recordToken(t, app, saveRecord(t, app, users, map[string]any{"email": "o1@example.com", "org": "o1"}))
+	admin := adminToken(t, app)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		status int
+	}{
+		{"guest search", "GET", "/api/collections/posts/records/full-text-search?search=hello", "", 200},
+		{"user debug", "GET", "/api/collections/posts/records/full-text-search?search=hello&debug=true", user, 403},
+		{"unknown language", "GET", "/api/collections/posts/records/full-text-search?search=hello&lang=en-US", "", 200},
+		{"admin debug", "GET", "/api/collections/posts/records/full-text-search?search=hello&debug=true", admin, 200},
+		{"guest refresh", "POST", "/api/collections/posts/records/full-text-search/refresh", "", 401},
+		{"user refresh", "POST", "/api/collections/posts/records/full-text-search/refresh", user, 401},
+		{"admin refresh", "POST", "/api/collections/posts_view/records/full-text-search/refresh", admin, 204},
+		{"collection without index", "GET", "/api/collections/users/records/full-text-search?search=hello", admin, 404},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := request(router, test.method, test.url, test.token); status != test.status {
+				t.Errorf("got status %d, want %d: %v", status, test.status, body)
+			}
+		})
+	}
+
+	posts, _ := app.Dao().FindCollectionByNameOrId("posts")
+	posts.ListRule = nil
+	saveCollection(t, app, posts)
+	for name, token := range map[string]string{"guest": "", "user": user} {
+		t.Run(name+" blocked by the list rule", func(t *testing.T) {
+			if status, body := request(router, "GET", "/api/collections/posts/records/full-text-search?search=hello", token); status != 403 {
+				t.Errorf("got status %d, want 403: %v", status, body)
+			}
+		})
+	}
+	t.Run("admin ignores the list rule", func(t *testing.T) {
+		status, body := request(router, "GET", "/api/collections/posts/records/full-text-search?search=hello", admin)
+		if status != 200 || body["totalItems"] != 2.0 {
+			t.Errorf("got status %d: %v", status, body)
+		}
+	})
+}
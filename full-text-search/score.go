@@ -0,0 +1,89 @@
+package full_text_search
+
+import (
+	"database/sql"
+	"math"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// ScoreRelative divides the rank of a hit by the best rank of the whole
+	// match set, so the best hit always scores 1.
+	ScoreRelative = "relative"
+	// ScoreSaturation maps the bm25 value x to x / (x + ScoreHalf), which
+	// doesn't depend on the other hits and can be compared between queries.
+	ScoreSaturation = "saturation"
+)
+
+var (
+	// ScoreFormula is the formula used for the score of the hits.
+	ScoreFormula = ScoreRelative
+	// ScoreHalf is the bm25 value that scores 0.5 with ScoreSaturation.
+	ScoreHalf = 1.0
+)
+
+// scorer converts FTS5 ranks, which are negative and unbounded bm25 values,
+// to scores between 0 and 1 and back.
+type scorer struct {
+	formula string
+	fts     string
+	best    float64
+}
+
+func newScorer(app *pocketbase.PocketBase, collection *models.Collection, match *ftsMatch, options SearchOptions) (*scorer, error) {
+	s := &scorer{formula: ScoreFormula, fts: match.fts}
+	if s.formula != ScoreRelative {
+		return s, nil
+	}
+
+	query, err := matchQuery(app, collection, match, options)
+	if err != nil {
+		return nil, err
+	}
+	var best sql.NullFloat64
+	err = query.
+		Distinct(false).
+		Select("MIN([[" + s.fts + ".rank]])").
+		OrderBy().
+		Row(&best)
+	if err != nil {
+		return nil, err
+	}
+	s.best = best.Float64
+	return s, nil
+}
+
+func (s *scorer) score(rank float64) float64 {
+	if s.formula == ScoreSaturation {
+		x := math.Max(-rank, 0)
+		return x / (x + ScoreHalf)
+	}
+	if s.best >= 0 {
+		return 1
+	}
+	return math.Min(math.Max(rank/s.best, 0), 1)
+}
+
+// maxRank is the highest rank that still has at least the given score.
+func (s *scorer) maxRank(score float64) float64 {
+	if s.formula == ScoreSaturation {
+		if score >= 1 {
+			return -math.MaxFloat64
+		}
+		return -(score * ScoreHalf / (1 - score))
+	}
+	return score * s.best
+}
+
+// filter drops the hits of query that score less than options.MinScore.
+func (s *scorer) filter(collection *models.Collection, query *dbx.SelectQuery, options SearchOptions) *dbx.SelectQuery {
+	if options.MinScore <= 0 {
+		return query
+	}
+	return query.AndWhere(dbx.NewExp("[["+s.fts+".rank]] <= {:maxRank}", dbx.Params{
+		"maxRank": s.maxRank(options.MinScore),
+	}))
+}
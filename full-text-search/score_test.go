@@ -0,0 +1,59 @@
+package full_text_search
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		scorer scorer
+		rank   float64
+		score  float64
+	}{
+		{"relative best hit", scorer{formula: ScoreRelative, best: -8}, -8, 1},
+		{"relative half of the best", scorer{formula: ScoreRelative, best: -8}, -4, 0.5},
+		{"relative zero rank", scorer{formula: ScoreRelative, best: -8}, 0, 0},
+		{"relative positive rank", scorer{formula: ScoreRelative, best: -8}, 2, 0},
+		{"relative better than the best", scorer{formula: ScoreRelative, best: -8}, -10, 1},
+		{"relative without a best rank", scorer{formula: ScoreRelative, best: 0}, -3, 1},
+		{"saturation half", scorer{formula: ScoreSaturation}, -ScoreHalf, 0.5},
+		{"saturation zero rank", scorer{formula: ScoreSaturation}, 0, 0},
+		{"saturation positive rank", scorer{formula: ScoreSaturation}, 3, 0},
+		{"saturation strong hit", scorer{formula: ScoreSaturation}, -3 * ScoreHalf, 0.75},
+		{"saturation huge rank", scorer{formula: ScoreSaturation}, -1e12, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score := test.scorer.score(test.rank)
+			if math.Abs(score-test.score) > 1e-9 {
+				t.Errorf("score(%v) = %v, want %v", test.rank, score, test.score)
+			}
+			if score < 0 || score > 1 {
+				t.Errorf("score(%v) = %v is out of [0, 1]", test.rank, score)
+			}
+		})
+	}
+}
+
+func TestMaxRank(t *testing.T) {
+	scorers := map[string]scorer{
+		ScoreRelative:   {formula: ScoreRelative, best: -8},
+		ScoreSaturation: {formula: ScoreSaturation},
+	}
+	for name, s := range scorers {
+		for _, score := range []float64{0.1, 0.25, 0.5, 0.9} {
+			rank := s.maxRank(score)
+			if got := s.score(rank); math.Abs(got-score) > 1e-9 {
+				t.Errorf("%s: score(maxRank(%v)) = %v", name, score, got)
+			}
+			if got := s.score(rank * 0.99); got >= score {
+				t.Errorf("%s: a rank above maxRank(%v) still scores %v", name, score, got)
+			}
+		}
+	}
+	if rank := (&scorer{formula: ScoreSaturation}).maxRank(1); rank != -math.MaxFloat64 {
+		t.Errorf("saturation: maxRank(1) = %v, want no rank", rank)
+	}
+}
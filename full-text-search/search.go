@@ -0,0 +1,495 @@
+package full_text_search
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/resolvers"
+	"github.com/pocketbase/pocketbase/tools/list"
+	"github.com/pocketbase/pocketbase/tools/search"
+)
+
+const (
+	DefaultPerPage = 30
+	MaxPerPage     = 500
+)
+
+var (
+	SnippetStart    = "<b>"
+	SnippetEnd      = "</b>"
+	SnippetEllipsis = "…"
+	SnippetTokens   = 16
+)
+
+var ErrNotIndexed = errors.New("collection has no full text search index")
+
+type SearchOptions struct {
+	Page    int
+	PerPage int
+	// Fuzzy also matches indexed terms within a small edit distance of the
+	// query words. Exact hits are still ranked first.
+	Fuzzy bool
+	// Fields restricts the match to these indexed fields.
+	Fields []string
+	// RequestInfo limits the results by the collection ListRule, the same
+	// way the records list API does. Leave it nil for unrestricted access.
+	RequestInfo *models.RequestInfo
+	// Debug adds the generated query, the bm25 score of every column and
+	// timings to the result.
+	Debug bool
+	// MinScore drops the hits that score less than this value (0-1).
+	MinScore float64
+	// Tenants limits the results to these tenants, when the collection has
+	// a TenantField. Searches by users are always limited to their tenant.
+	Tenants []string
+	// Language searches the index of this language, when the collection
+	// has a LanguageField. Empty or unknown languages search the records
+	// of all languages.
+	Language string
+	// Facets are select and relation fields whose values are counted over
+	// the whole match set.
+	Facets []string
+}
+
+type SearchHit struct {
+	Record   *models.Record    `json:"record"`
+	Rank     float64           `json:"rank"`
+	Score    float64           `json:"score"`
+	Snippets map[string]string `json:"snippets"`
+}
+
+type SearchResult struct {
+	Page       int          `json:"page"`
+	PerPage    int          `json:"perPage"`
+	TotalItems int          `json:"totalItems"`
+	TotalPages int          `json:"totalPages"`
+	Items      []*SearchHit `json:"items"`
+	// Facets maps every requested facet to the counts of its values.
+	Facets map[string][]*FacetCount `json:"facets,omitempty"`
+	Debug  *SearchDebug             `json:"debug,omitempty"`
+}
+
+type SearchDebug struct {
+	// Match is the final FTS5 expression, after fuzzy expansion and column
+	// filters. Exact is the expression that ranks exact hits first.
+	Match   string        `json:"match"`
+	Exact   string        `json:"exact,omitempty"`
+	Queries []*DebugQuery `json:"queries"`
+	Hits    []*DebugHit   `json:"hits"`
+	// MatchMs is the time spent in the MATCH queries and HydrateMs the time
+	// spent loading the records, in milliseconds.
+	MatchMs   float64 `json:"matchMs"`
+	HydrateMs float64 `json:"hydrateMs"`
+}
+
+type DebugQuery struct {
+	SQL    string     `json:"sql"`
+	Params dbx.Params `json:"params"`
+}
+
+type DebugHit struct {
+	Id   string  `json:"id"`
+	Rank float64 `json:"rank"`
+	// Columns is the bm25 score of the hit when only that column is weighted.
+	Columns map[string]float64 `json:"columns"`
+}
+
+type IndexStatus struct {
+	Collection string   `json:"collection"`
+	Indexed    bool     `json:"indexed"`
+	Fields     []string `json:"fields"`
+	Documents  int      `json:"documents"`
+}
+
+// Search runs an FTS5 MATCH query against the index of a collection and
+// returns the matching records ordered by rank.
+func Search(app *pocketbase.PocketBase, target string, q string, options SearchOptions) (*SearchResult, error) {
+	collection, err := findCollectionFts(app, target)
+	if err != nil {
+		return nil, err
+	}
+	tbl := collection.Name
+	match, err := newMatch(app, collection, q, options)
+	if err != nil {
+		return nil, err
+	}
+	fts := match.fts
+
+	page := options.Page
+	if page <= 0 {
+		page = 1
+	}
+	perPage := options.PerPage
+	if perPage <= 0 {
+		perPage = DefaultPerPage
+	}
+	if perPage > MaxPerPage {
+		perPage = MaxPerPage
+	}
+
+	result := &SearchResult{
+		Page:    page,
+		PerPage: perPage,
+		Items:   []*SearchHit{},
+	}
+
+	matchStart := time.Now()
+	scorer, err := newScorer(app, collection, match, options)
+	if err != nil {
+		return nil, err
+	}
+	countQuery, err := matchQuery(app, collection, match, options)
+	if err != nil {
+		return nil, err
+	}
+	count := scorer.filter(collection, countQuery, options).
+		Distinct(false).
+		Select("COUNT(DISTINCT [[" + tbl + ".id]])").
+		OrderBy().
+		Build()
+	if err := count.Row(&result.TotalItems); err != nil {
+		return nil, err
+	}
+	if options.Debug {
+		result.Debug = &SearchDebug{
+			Match:   fmt.Sprint(count.Params()["match"]),
+			Queries: []*DebugQuery{{SQL: count.SQL(), Params: count.Params()}},
+			Hits:    []*DebugHit{},
+		}
+		if exact, ok := count.Params()["exact"]; ok {
+			result.Debug.Exact = fmt.Sprint(exact)
+		}
+	}
+	if len(options.Facets) > 0 {
+		facets, queries, err := searchFacets(app, collection, match, options, scorer)
+		if err != nil {
+			return nil, err
+		}
+		result.Facets = facets
+		if result.Debug != nil {
+			for _, query := range queries {
+				result.Debug.Queries = append(result.Debug.Queries, &DebugQuery{SQL: query.SQL(), Params: query.Params()})
+			}
+		}
+	}
+	result.TotalPages = int(math.Ceil(float64(result.TotalItems) / float64(perPage)))
+	if result.TotalItems == 0 {
+		if result.Debug != nil {
+			result.Debug.MatchMs = float64(time.Since(matchStart).Microseconds()) / 1000
+		}
+		return result, nil
+	}
+
+	fields := collectionFields(collection, "id")
+	columns := []string{"[[" + tbl + ".id]] AS id", "[[" + fts + ".rank]] AS __rank"}
+	for i, field := range fields {
+		if i == 0 {
+			continue
+		}
+		columns = append(columns, "snippet("+fts+", "+fmt.Sprint(i)+", {:start}, {:end}, {:ellipsis}, {:tokens}) AS __snippet_"+field)
+		if options.Debug {
+			weights := make([]string, len(fields))
+			for j := range weights {
+				weights[j] = "0"
+			}
+			weights[i] = "1"
+			columns = append(columns, "bm25("+fts+", "+strings.Join(weights, ", ")+") AS __bm25_"+field)
+		}
+	}
+
+	query, err := matchQuery(app, collection, match, options)
+	if err != nil {
+		return nil, err
+	}
+	rows := []dbx.NullStringMap{}
+	matches := scorer.filter(collection, query, options).
+		Select(columns...).
+		AndBind(dbx.Params{
+			"start":    SnippetStart,
+			"end":      SnippetEnd,
+			"ellipsis": SnippetEllipsis,
+			"tokens":   SnippetTokens,
+		}).
+		Limit(int64(perPage)).
+		Offset(int64((page - 1) * perPage)).
+		Build()
+	if err := matches.All(&rows); err != nil {
+		return nil, err
+	}
+	matchTime := time.Since(matchStart)
+
+	hydrateStart := time.Now()
+	ids := []string{}
+	for _, row := range rows {
+		ids = append(ids, row["id"].String)
+	}
+	records, err := app.Dao().FindRecordsByIds(collection.Id, ids)
+	if err != nil {
+		return nil, err
+	}
+	hydrateTime := time.Since(hydrateStart)
+
+	if result.Debug != nil {
+		result.Debug.Queries = append(result.Debug.Queries, &DebugQuery{SQL: matches.SQL(), Params: matches.Params()})
+		result.Debug.MatchMs = float64(matchTime.Microseconds()) / 1000
+		result.Debug.HydrateMs = float64(hydrateTime.Microseconds()) / 1000
+	}
+	recordsById := map[string]*models.Record{}
+	for _, record := range records {
+		recordsById[record.Id] = record
+	}
+
+	for _, row := range rows {
+		record, ok := recordsById[row["id"].String]
+		if !ok {
+			continue
+		}
+		rank, _ := strconv.ParseFloat(row["__rank"].String, 64)
+		hit := &SearchHit{
+			Record:   record,
+			Rank:     rank,
+			Score:    scorer.score(rank),
+			Snippets: map[string]string{},
+		}
+		for i, field := range fields {
+			if i == 0 {
+				continue
+			}
+			snippet := row["__snippet_"+field]
+			if snippet.Valid && strings.Contains(snippet.String, SnippetStart) {
+				hit.Snippets[field] = snippet.String
+			}
+		}
+		result.Items = append(result.Items, hit)
+
+		if result.Debug != nil {
+			debugHit := &DebugHit{
+				Id:      record.Id,
+				Rank:    rank,
+				Columns: map[string]float64{},
+			}
+			for i, field := range fields {
+				if i == 0 {
+					continue
+				}
+				score, _ := strconv.ParseFloat(row["__bm25_"+field].String, 64)
+				debugHit.Columns[field] = score
+			}
+			result.Debug.Hits = append(result.Debug.Hits, debugHit)
+		}
+	}
+
+	return result, nil
+}
+
+// ftsMatch is the MATCH expression of a search. It is built once, since
+// the fuzzy expansion scans the vocabulary, and shared by all the queries of
+// the search.
+type ftsMatch struct {
+	fts   string
+	match string
+	// exact matches the hits that are ranked first, when fuzzy.
+	exact string
+}
+
+func newMatch(app *pocketbase.PocketBase, collection *models.Collection, q string, options SearchOptions) (*ftsMatch, error) {
+	fts := ftsTable(collection, options.Language)
+	match := &ftsMatch{fts: fts, match: q}
+	if options.Fuzzy {
+		var err error
+		match.match, match.exact, err = fuzzyQuery(app, fts, q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Fields) > 0 {
+		colset, err := columnFilter(collection, options.Fields)
+		if err != nil {
+			return nil, err
+		}
+		match.match = colset + " : (" + match.match + ")"
+		if match.exact != "" {
+			match.exact = colset + " : (" + match.exact + ")"
+		}
+	}
+	return match, nil
+}
+
+// matchQuery selects the records of a collection that match, ordered by
+// rank and limited by the collection ListRule when options.RequestInfo is set.
+func matchQuery(app *pocketbase.PocketBase, collection *models.Collection, match *ftsMatch, options SearchOptions) (*dbx.SelectQuery, error) {
+	tbl := collection.Name
+	fts := match.fts
+
+	order := "[[" + fts + ".rank]]"
+	params := dbx.Params{"match": match.match}
+	if match.exact != "" {
+		order = "[[" + fts + ".rowid]] IN (SELECT rowid FROM " + fts + " WHERE " + fts + " MATCH {:exact}) DESC, " + order
+		params["exact"] = match.exact
+	}
+
+	query := app.Dao().RecordQuery(collection)
+	if collection.IsView() {
+		query.
+			InnerJoin(tbl+"_fts_ids", dbx.NewExp("[["+tbl+"_fts_ids.id]] = [["+tbl+".id]]")).
+			InnerJoin(fts, dbx.NewExp("[["+fts+".rowid]] = [["+tbl+"_fts_ids.rowid]]"))
+	} else {
+		query.InnerJoin(fts, dbx.NewExp("[["+fts+".rowid]] = [["+tbl+".rowid]]"))
+	}
+	query.
+		AndWhere(dbx.NewExp("[[" + fts + "]] MATCH {:match}")).
+		OrderBy(order).
+		AndBind(params)
+
+	info := options.RequestInfo
+	if tenantField := CollectionConfigs[tbl].TenantField; tenantField != "" {
+		tenants := options.Tenants
+		if info != nil && info.Admin == nil {
+			tenants = authTenants(collection, info)
+			if len(tenants) == 0 {
+				query.AndWhere(dbx.NewExp("1 = 0"))
+			}
+		}
+		if len(tenants) > 0 {
+			// The index of a view is contentless, its tenant column reads
+			// as NULL, so views are filtered by the column of the view.
+			column := "[[" + fts + "." + tenantField + "]]"
+			if collection.IsView() {
+				column = "[[" + tbl + "." + tenantField + "]]"
+			}
+			query.AndWhere(dbx.In(column, list.ToInterfaceSlice(tenants)...))
+		}
+	}
+	if info != nil && info.Admin == nil {
+		if collection.ListRule == nil {
+			return nil, apis.NewForbiddenError("Only admins can perform this action.", nil)
+		}
+		if *collection.ListRule != "" {
+			resolver := resolvers.NewRecordFieldResolver(app.Dao(), collection, info, false)
+			expr, err := search.FilterData(*collection.ListRule).BuildExpr(resolver)
+			if err != nil {
+				return nil, err
+			}
+			query.AndWhere(expr)
+			resolver.UpdateQuery(query)
+		}
+	}
+
+	return query, nil
+}
+
+// Rebuild repopulates the index of a collection from its records.
+func Rebuild(app *pocketbase.PocketBase, target string) error {
+	collection, err := findCollectionFts(app, target)
+	if err != nil {
+		return err
+	}
+	return syncCollection(app, collection.Name)
+}
+
+// Status reports whether a collection is indexed and how many records the
+// index covers.
+func Status(app *pocketbase.PocketBase, target string) (*IndexStatus, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return nil, err
+	}
+	status := &IndexStatus{
+		Collection: collection.Name,
+		Fields:     collectionFields(collection, "id"),
+	}
+	status.Indexed, _ = checkIfTableExists(app, collection.Name+"_fts")
+	if !status.Indexed {
+		return status, nil
+	}
+
+	err = app.Dao().DB().
+		NewQuery("SELECT COUNT(*) FROM " + collection.Name + "_fts_docsize;").
+		Row(&status.Documents)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Drop removes the index of a collection together with its sync triggers.
+func Drop(app *pocketbase.PocketBase, target string) error {
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return err
+	}
+	return deleteCollection(app, collection.Name)
+}
+
+func findCollectionFts(app *pocketbase.PocketBase, target string) (*models.Collection, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := checkIfTableExists(app, collection.Name+"_fts")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotIndexed
+	}
+	return collection, nil
+}
+
+// columnFilter builds an FTS5 column filter, only allowing fields that are
+// part of the index.
+func columnFilter(collection *models.Collection, fields []string) (string, error) {
+	indexed := collectionFields(collection, "id")
+	columns := []string{}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == "id" || field == CollectionConfigs[collection.Name].TenantField || !slices.Contains(indexed, field) {
+			return "", fmt.Errorf("%q is not an indexed field of %s", field, collection.Name)
+		}
+		columns = append(columns, field)
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no fields to search in %s", collection.Name)
+	}
+	return "{" + strings.Join(surround(columns, "\"", "\""), " ") + "}", nil
+}
+
+// authTenants are the tenants of the user that made the request.
+func authTenants(collection *models.Collection, info *models.RequestInfo) []string {
+	if info.AuthRecord == nil {
+		return nil
+	}
+	config := CollectionConfigs[collection.Name]
+	field := config.AuthTenantField
+	if field == "" {
+		field = config.TenantField
+	}
+	return list.ToUniqueStringSlice(info.AuthRecord.Get(field))
+}
+
+func findIndexedCollection(app *pocketbase.PocketBase, target string, collections ...string) (*models.Collection, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range collections {
+		if col == collection.Name {
+			return collection, nil
+		}
+	}
+	return nil, apis.NewNotFoundError("Full text search is not enabled for "+collection.Name+".", nil)
+}
@@ -0,0 +1,187 @@
+package full_text_search
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// newPostsApp creates a posts collection and a posts_view view collection,
+// both listed by everyone and indexed with the org tenant field, and users
+// with the same org field.
+func newPostsApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+	app := newTestApp(t)
+
+	users, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Schema.AddField(&schema.SchemaField{Name: "org", Type: schema.FieldTypeText})
+	saveCollection(t, app, users)
+
+	posts := saveCollection(t, app, &models.Collection{
+		Name:     "posts",
+		Type:     models.CollectionTypeBase,
+		ListRule: types.Pointer(""),
+		Schema: schema.NewSchema(
+			&schema.SchemaField{Name: "title", Type: schema.FieldTypeText},
+			&schema.SchemaField{Name: "org", Type: schema.FieldTypeText},
+		),
+	})
+	saveCollection(t, app, &models.Collection{
+		Name:     "posts_view",
+		Type:     models.CollectionTypeView,
+		ListRule: types.Pointer(""),
+		Options: types.JsonMap{
+			"query": "SELECT id, title, org FROM posts",
+		},
+	})
+	saveRecord(t, app, posts, map[string]any{"title": "hello one", "org": "o1"})
+	saveRecord(t, app, posts, map[string]any{"title": "hello two", "org": "o2"})
+
+	setConfig(t, "posts", CollectionConfig{TenantField: "org"})
+	setConfig(t, "posts_view", CollectionConfig{TenantField: "org"})
+	if err := Init(app, "posts", "posts_view"); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestSearchTenants(t *testing.T) {
+	app := newPostsApp(t)
+	router := serve(t, app)
+
+	users, _ := app.Dao().FindCollectionByNameOrId("users")
+	user := recordToken(t, app, saveRecord(t, app, users, map[string]any{"email": "o1@example.com", "org": "o1"}))
+	orgless := recordToken(t, app, saveRecord(t, app, users, map[string]any{"email": "none@example.com"}))
+	admin := adminToken(t, app)
+
+	for _, target := range []string{"posts", "posts_view"} {
+		tests := []struct {
+			name  string
+			token string
+			orgs  []string
+		}{
+			{"user of o1", user, []string{"o1"}},
+			{"user without org", orgless, []string{}},
+			{"guest", "", []string{}},
+			{"admin", admin, []string{"o1", "o2"}},
+		}
+		for _, test := range tests {
+			t.Run(target+"/"+test.name, func(t *testing.T) {
+				status, body := request(router, "GET", "/api/collections/"+target+"/records/full-text-search?search=hello", test.token)
+				if status != 200 {
+					t.Fatalf("got status %d: %v", status, body)
+				}
+				orgs := []string{}
+				for _, item := range body["items"].([]any) {
+					record := item.(map[string]any)["record"].(map[string]any)
+					orgs = append(orgs, record["org"].(string))
+				}
+				if !equalSets(orgs, test.orgs) {
+					t.Errorf("got the records of %v, want %v", orgs, test.orgs)
+				}
+			})
+		}
+
+		t.Run(target+"/admin with tenants", func(t *testing.T) {
+			result, err := Search(app, target, "hello", SearchOptions{
+				RequestInfo: &models.RequestInfo{Admin: &models.Admin{}},
+				Tenants:     []string{"o2"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.TotalItems != 1 || result.Items[0].Record.GetString("org") != "o2" {
+				t.Errorf("got %d hits, want the record of o2", result.TotalItems)
+			}
+		})
+	}
+}
+
+func TestTenantFieldsAreChecked(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CollectionConfig
+		valid  bool
+	}{
+		{"tenant field", CollectionConfig{TenantField: "org"}, true},
+		{"auth tenant field", CollectionConfig{TenantField: "org", AuthTenantField: "org"}, true},
+		{"missing tenant field", CollectionConfig{TenantField: "orgs"}, false},
+		{"missing auth tenant field", CollectionConfig{TenantField: "org", AuthTenantField: "team"}, false},
+		{"auth tenant field without tenant field", CollectionConfig{AuthTenantField: "org"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newPostsApp(t)
+			posts, _ := app.Dao().FindCollectionByNameOrId("posts")
+			setConfig(t, "posts", test.config)
+			err := checkTenantFields(app, posts)
+			if test.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func equalSets(a []string, b []string) bool {
+	seen := map[string]int{}
+	for _, item := range a {
+		seen[item]++
+	}
+	for _, item := range b {
+		seen[item]--
+	}
+	for _, count := range seen {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIndexLifecycle(t *testing.T) {
+	for _, target := range []string{"posts", "posts_view"} {
+		t.Run(target, func(t *testing.T) {
+			app := newPostsApp(t)
+			serve(t, app)
+
+			status, err := Status(app, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !status.Indexed || status.Documents != 2 {
+				t.Errorf("got %+v, want 2 indexed documents", status)
+			}
+
+			collection, _ := app.Dao().FindCollectionByNameOrId("posts")
+			saveRecord(t, app, collection, map[string]any{"title": "hello three", "org": "o1"})
+			if err := Rebuild(app, target); err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := Status(app, target); status.Documents != 3 {
+				t.Errorf("got %d documents after the rebuild, want 3", status.Documents)
+			}
+
+			if err := Drop(app, target); err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := Status(app, target); status.Indexed {
+				t.Error("the index is still there after the drop")
+			}
+			if _, err := Search(app, target, "hello", SearchOptions{}); err != ErrNotIndexed {
+				t.Errorf("got %v searching a dropped index, want ErrNotIndexed", err)
+			}
+			if err := Rebuild(app, target); err != ErrNotIndexed {
+				t.Errorf("got %v rebuilding a dropped index, want ErrNotIndexed", err)
+			}
+		})
+	}
+}
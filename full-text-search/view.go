@@ -0,0 +1,155 @@
+package full_text_search
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+)
+
+// View collections are backed by SQL views that triggers can't be attached
+// to, so they get a contentless index that is rebuilt on a schedule. The
+// index rowids map to record ids through the <name>_fts_ids table.
+//
+// https://www.sqlite.org/fts5.html#contentless_tables
+func createViewFts(app *pocketbase.PocketBase, collection *models.Collection, fields []string) error {
+	target := collection.Name
+	var stmt strings.Builder
+	stmt.WriteString("CREATE VIRTUAL TABLE " + target + "_fts USING FTS5 (")
+	stmt.WriteString("  " + strings.Join(columnDefs(collection, fields), ", ") + ",")
+	stmt.WriteString("  content=''")
+	stmt.WriteString(");")
+	app.Logger().Info(stmt.String())
+	if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
+
+	stmt.Reset()
+	stmt.WriteString("CREATE TABLE IF NOT EXISTS " + target + "_fts_ids (")
+	stmt.WriteString("  rowid INTEGER PRIMARY KEY,")
+	stmt.WriteString("  id TEXT NOT NULL")
+	stmt.WriteString(");")
+	app.Logger().Info(stmt.String())
+	if _, err := app.Dao().DB().NewQuery(stmt.String()).Execute(); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		return err
+	}
+
+	return nil
+}
+
+func refreshViewFts(app *pocketbase.PocketBase, collection *models.Collection, fields []string) error {
+	target := collection.Name
+	tbl := "`" + target + "`"
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		stmts := []string{
+			"INSERT INTO " + target + "_fts(" + target + "_fts) VALUES('delete-all');",
+			"DELETE FROM " + target + "_fts_ids;",
+			"INSERT INTO " + target + "_fts_ids (id) SELECT id FROM " + tbl + ";",
+			"INSERT INTO " + target + "_fts(rowid, " + strings.Join(fields, ", ") + ") " +
+				"SELECT i.rowid, " + strings.Join(surround(fields, "v.", ""), ", ") + " " +
+				"FROM " + target + "_fts_ids i INNER JOIN " + tbl + " v ON v.id = i.id;",
+		}
+		for _, index := range collectionIndexes(target)[1:] {
+			stmts = append(stmts,
+				"INSERT INTO "+index.table+"("+index.table+") VALUES('delete-all');",
+				"INSERT INTO "+index.table+"(rowid, "+strings.Join(fields, ", ")+") "+
+					"SELECT i.rowid, "+strings.Join(surround(fields, "v.", ""), ", ")+" "+
+					"FROM "+target+"_fts_ids i INNER JOIN "+tbl+" v ON v.id = i.id"+index.where(collection, "v.")+";",
+			)
+		}
+		for _, stmt := range stmts {
+			app.Logger().Info(stmt)
+			if _, err := txDao.DB().NewQuery(stmt).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scheduleViewRefresh rebuilds the indexes of the view collections on their
+// RefreshSchedule. The jobs are keyed by collection id and follow the
+// collections created, renamed and deleted after startup.
+func scheduleViewRefresh(app *pocketbase.PocketBase, collections ...string) *cron.Cron {
+	scheduler := cron.New()
+	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
+		for _, target := range collections {
+			collection, err := app.Dao().FindCollectionByNameOrId(target)
+			if err != nil {
+				continue
+			}
+			if err := scheduleRefresh(app, scheduler, collection); err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
+		}
+		// Started even without views, for the ones created later.
+		scheduler.Start()
+		return nil
+	})
+	app.OnCollectionAfterCreateRequest().Add(func(e *core.CollectionCreateEvent) error {
+		if !slices.Contains(collections, e.Collection.Name) {
+			return nil
+		}
+		if err := scheduleRefresh(app, scheduler, e.Collection); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		return nil
+	})
+	app.OnCollectionAfterUpdateRequest().Add(func(e *core.CollectionUpdateEvent) error {
+		if !slices.Contains(collections, e.Collection.Name) {
+			scheduler.Remove(refreshJobId(e.Collection))
+			return nil
+		}
+		if err := scheduleRefresh(app, scheduler, e.Collection); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		return nil
+	})
+	app.OnCollectionAfterDeleteRequest().Add(func(e *core.CollectionDeleteEvent) error {
+		scheduler.Remove(refreshJobId(e.Collection))
+		return nil
+	})
+	app.OnTerminate().Add(func(e *core.TerminateEvent) error {
+		scheduler.Stop()
+		return nil
+	})
+	return scheduler
+}
+
+// scheduleRefresh replaces the refresh job of a collection, and removes it
+// when the collection isn't a view.
+func scheduleRefresh(app *pocketbase.PocketBase, scheduler *cron.Cron, collection *models.Collection) error {
+	scheduler.Remove(refreshJobId(collection))
+	if !collection.IsView() {
+		return nil
+	}
+	schedule := DefaultRefreshSchedule
+	if config, ok := CollectionConfigs[collection.Name]; ok && config.RefreshSchedule != "" {
+		schedule = config.RefreshSchedule
+	}
+	id := collection.Id
+	err := scheduler.Add(refreshJobId(collection), schedule, func() {
+		collection, err := app.Dao().FindCollectionByNameOrId(id)
+		if err == nil {
+			err = syncCollection(app, collection.Name)
+		}
+		if err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+		}
+	})
+	return err
+}
+
+func refreshJobId(collection *models.Collection) string {
+	return "fts_refresh_" + collection.Id
+}
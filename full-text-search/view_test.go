@@ -0,0 +1,55 @@
+package full_text_search
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func TestViewRefreshJobs(t *testing.T) {
+	app := newPostsApp(t)
+	scheduler := scheduleViewRefresh(app, "posts", "posts_view", "drafts_view")
+	serve(t, app)
+	if total := scheduler.Total(); total != 1 {
+		t.Fatalf("got %d jobs at startup, want the job of posts_view", total)
+	}
+
+	drafts := saveCollection(t, app, &models.Collection{
+		Name:    "drafts_view",
+		Type:    models.CollectionTypeView,
+		Options: types.JsonMap{"query": "SELECT id, title FROM posts"},
+	})
+	steps := []struct {
+		name    string
+		trigger func() error
+		total   int
+	}{
+		{"view created", func() error {
+			return app.OnCollectionAfterCreateRequest().Trigger(&core.CollectionCreateEvent{BaseCollectionEvent: core.BaseCollectionEvent{Collection: drafts}})
+		}, 2},
+		{"view updated", func() error {
+			return app.OnCollectionAfterUpdateRequest().Trigger(&core.CollectionUpdateEvent{BaseCollectionEvent: core.BaseCollectionEvent{Collection: drafts}})
+		}, 2},
+		{"view renamed out of the indexed collections", func() error {
+			drafts.Name = "archive_view"
+			return app.OnCollectionAfterUpdateRequest().Trigger(&core.CollectionUpdateEvent{BaseCollectionEvent: core.BaseCollectionEvent{Collection: drafts}})
+		}, 1},
+		{"view renamed back", func() error {
+			drafts.Name = "drafts_view"
+			return app.OnCollectionAfterUpdateRequest().Trigger(&core.CollectionUpdateEvent{BaseCollectionEvent: core.BaseCollectionEvent{Collection: drafts}})
+		}, 2},
+		{"view deleted", func() error {
+			return app.OnCollectionAfterDeleteRequest().Trigger(&core.CollectionDeleteEvent{BaseCollectionEvent: core.BaseCollectionEvent{Collection: drafts}})
+		}, 1},
+	}
+	for _, step := range steps {
+		if err := step.trigger(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if total := scheduler.Total(); total != step.total {
+			t.Fatalf("%s: got %d jobs, want %d", step.name, total, step.total)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 
+	"github.com/dop251/goja"
 	"github.com/pocketbase/pocketbase"
 	env_config "github.com/rodydavis/pocketbase-plugins/env-config"
 	full_text_search "github.com/rodydavis/pocketbase-plugins/full-text-search"
@@ -13,6 +14,21 @@ import (
 func main() {
 	app := pocketbase.New()
 
+	vectorCollections := []vector_search.VectorCollection{
+		{
+			Name: "vectors",
+		},
+	}
+
+	fullTextSearchCollections := []string{}
+	for _, col := range vectorCollections {
+		fullTextSearchCollections = append(fullTextSearchCollections, col.Name)
+	}
+
+	env_config.JsvmBindings = append(env_config.JsvmBindings, func(vm *goja.Runtime) {
+		full_text_search.BindJsvm(app, vm, fullTextSearchCollections...)
+	})
+
 	err := env_config.Init(app)
 	if err != nil {
 		log.Fatal(err)
@@ -23,20 +39,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	vectorCollections := []vector_search.VectorCollection{
-		{
-			Name: "vectors",
-		},
-	}
 	err = vector_search.Init(app, vectorCollections...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fullTextSearchCollections := []string{}
-	for _, col := range vectorCollections {
-		fullTextSearchCollections = append(fullTextSearchCollections, col.Name)
-	}
 	err = full_text_search.Init(app, fullTextSearchCollections...)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,219 @@
+package vector_search
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+)
+
+// Embeddings are cached in the _embedding_cache table, shared by all the
+// collections, by model, dimensions, task type and hash of the text. Both
+// the chunks of records and search queries are looked up there before the
+// embedder is called.
+
+var (
+	// EmbeddingCacheSize is the maximum number of cached embeddings. The
+	// least recently used ones are evicted first. The cache is disabled when
+	// it is 0.
+	EmbeddingCacheSize = 100_000
+	// EmbeddingCacheTTL is how long an embedding stays cached after it was
+	// created, forever when it is 0.
+	EmbeddingCacheTTL = 30 * 24 * time.Hour
+	// EmbeddingCacheTouchInterval is how old the last use of an embedding
+	// must be before a hit records it again, so that most hits don't write.
+	EmbeddingCacheTouchInterval = time.Hour
+	// EmbeddingCacheEvictEvery is how many embeddings are cached between two
+	// evictions. The cache can exceed EmbeddingCacheSize by this much.
+	EmbeddingCacheEvictEvery = 1000
+)
+
+// cacheLookupSize is the maximum number of hashes per lookup query.
+const cacheLookupSize = 500
+
+// cacheInserts counts the cached embeddings, to evict every
+// EmbeddingCacheEvictEvery of them.
+var cacheInserts atomic.Int64
+
+type cachedEmbedding struct {
+	Hash   string `db:"hash"`
+	Vector []byte `db:"vector"`
+	Used   int64  `db:"used"`
+}
+
+func createCacheTable(app *pocketbase.PocketBase) error {
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS _embedding_cache (" +
+			"  model TEXT NOT NULL," +
+			"  dimensions INTEGER NOT NULL," +
+			"  task_type TEXT NOT NULL," +
+			"  hash TEXT NOT NULL," +
+			"  vector BLOB NOT NULL," +
+			"  created INTEGER NOT NULL," +
+			"  used INTEGER NOT NULL," +
+			"  PRIMARY KEY (model, dimensions, task_type, hash)" +
+			");",
+		"CREATE INDEX IF NOT EXISTS idx_embedding_cache_used ON _embedding_cache (used);",
+	}
+	for _, stmt := range stmts {
+		app.Logger().Info(stmt)
+		if _, err := app.DB().NewQuery(stmt).Execute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func textHash(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+// cacheTaskType is the task type of the cache key. It includes the prefix
+// that the embedder prepends to the texts, since it changes their vectors.
+func cacheTaskType(config VectorCollection, taskType TaskType) string {
+	if ollama, ok := config.Embedder.(*OllamaEmbedder); ok {
+		if prefix := ollama.taskPrefix(taskType); prefix != "" {
+			return string(taskType) + ":" + prefix
+		}
+	}
+	return string(taskType)
+}
+
+// cachedVectors returns the cached embeddings of the hashes that aren't
+// expired, and marks the ones that weren't used recently as used.
+func cachedVectors(app *pocketbase.PocketBase, config VectorCollection, taskType TaskType, hashes []string) (map[string][]float32, error) {
+	vectors := map[string][]float32{}
+	if EmbeddingCacheSize <= 0 || len(hashes) == 0 {
+		return vectors, nil
+	}
+	key := dbx.HashExp{
+		"model":      config.Model,
+		"dimensions": config.Dimensions,
+		"task_type":  cacheTaskType(config, taskType),
+	}
+	now := time.Now().UnixMilli()
+	touched := now - EmbeddingCacheTouchInterval.Milliseconds()
+	for start := 0; start < len(hashes); start += cacheLookupSize {
+		values := []any{}
+		for _, hash := range hashes[start:min(start+cacheLookupSize, len(hashes))] {
+			values = append(values, hash)
+		}
+		query := app.DB().
+			Select("hash", "vector", "used").
+			From("_embedding_cache").
+			Where(key).
+			AndWhere(dbx.In("hash", values...))
+		if EmbeddingCacheTTL > 0 {
+			query.AndWhere(dbx.NewExp("created > {:expired}", dbx.Params{"expired": now - EmbeddingCacheTTL.Milliseconds()}))
+		}
+		items := []*cachedEmbedding{}
+		if err := query.All(&items); err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			continue
+		}
+		used := []any{}
+		for _, item := range items {
+			vector := decodeVector(item.Vector)
+			if len(vector) != config.Dimensions {
+				continue
+			}
+			vectors[item.Hash] = vector
+			if item.Used <= touched {
+				used = append(used, item.Hash)
+			}
+		}
+		if len(used) == 0 {
+			continue
+		}
+		_, err := app.DB().
+			Update("_embedding_cache", dbx.Params{"used": now}, dbx.And(key, dbx.In("hash", used...))).
+			Execute()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vectors, nil
+}
+
+// cacheVectors saves new embeddings, and every EmbeddingCacheEvictEvery of
+// them evicts the expired and least recently used ones.
+func cacheVectors(app *pocketbase.PocketBase, config VectorCollection, taskType TaskType, hashes []string, vectors [][]float32) error {
+	if EmbeddingCacheSize <= 0 || len(hashes) == 0 {
+		return nil
+	}
+	now := time.Now().UnixMilli()
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for i, hash := range hashes {
+			_, err := txDao.DB().NewQuery(
+				"INSERT OR REPLACE INTO _embedding_cache (model, dimensions, task_type, hash, vector, created, used) " +
+					"VALUES ({:model}, {:dimensions}, {:task_type}, {:hash}, {:vector}, {:now}, {:now});",
+			).Bind(dbx.Params{
+				"model":      config.Model,
+				"dimensions": config.Dimensions,
+				"task_type":  cacheTaskType(config, taskType),
+				"hash":       hash,
+				"vector":     encodeVector(vectors[i]),
+				"now":        now,
+			}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		inserts := cacheInserts.Add(int64(len(hashes)))
+		every := int64(max(EmbeddingCacheEvictEvery, 1))
+		if (inserts-int64(len(hashes)))/every == inserts/every {
+			return nil
+		}
+		return evictCache(txDao.DB(), now)
+	})
+}
+
+func evictCache(db dbx.Builder, now int64) error {
+	if EmbeddingCacheTTL > 0 {
+		_, err := db.
+			NewQuery("DELETE FROM _embedding_cache WHERE created <= {:expired};").
+			Bind(dbx.Params{"expired": now - EmbeddingCacheTTL.Milliseconds()}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+	count := 0
+	if err := db.NewQuery("SELECT COUNT(*) FROM _embedding_cache;").Row(&count); err != nil {
+		return err
+	}
+	if count <= EmbeddingCacheSize {
+		return nil
+	}
+	_, err := db.
+		NewQuery("DELETE FROM _embedding_cache WHERE rowid IN (SELECT rowid FROM _embedding_cache ORDER BY used ASC LIMIT {:excess});").
+		Bind(dbx.Params{"excess": count - EmbeddingCacheSize}).
+		Execute()
+	return err
+}
+
+// encodeVector stores a vector as little endian float32 values.
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
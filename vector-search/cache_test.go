@@ -0,0 +1,66 @@
+package vector_search
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestEmbeddingCache(t *testing.T) {
+	embedder := &testEmbedder{}
+	configs := []VectorCollection{{Name: "docs", Embedder: embedder}}
+	app := newTestApp(t, configs)
+	if err := setupCollections(app, configs); err != nil {
+		t.Fatal(err)
+	}
+	config := configs[0]
+
+	tests := []struct {
+		name     string
+		texts    []string
+		taskType TaskType
+		embedded []string
+	}{
+		{"new texts", []string{"a", "b", "a"}, TaskTypeDocument, []string{"a", "b"}},
+		{"cached texts", []string{"b", "a"}, TaskTypeDocument, nil},
+		{"cached and new texts", []string{"a", "c"}, TaskTypeDocument, []string{"c"}},
+		{"other task type", []string{"a"}, TaskTypeQuery, []string{"a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors, err := embedBatches(context.Background(), app, config, test.texts, test.taskType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if texts := embedder.embedded(); !slices.Equal(texts, test.embedded) {
+				t.Errorf("embedded %q, want %q", texts, test.embedded)
+			}
+			want, _ := embedder.Embed(context.Background(), test.texts, test.taskType)
+			embedder.embedded()
+			for i := range vectors {
+				if !slices.Equal(vectors[i], want[i]) {
+					t.Errorf("got %v for %q, want %v", vectors[i], test.texts[i], want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		size := EmbeddingCacheSize
+		EmbeddingCacheSize = 0
+		t.Cleanup(func() { EmbeddingCacheSize = size })
+		if _, err := embedBatches(context.Background(), app, config, []string{"a"}, TaskTypeDocument); err != nil {
+			t.Fatal(err)
+		}
+		if texts := embedder.embedded(); !slices.Equal(texts, []string{"a"}) {
+			t.Errorf("embedded %q, want the text again", texts)
+		}
+	})
+}
+
+func TestEncodeVector(t *testing.T) {
+	vector := []float32{0, -1.5, 3.25, 1e-7}
+	if decoded := decodeVector(encodeVector(vector)); !slices.Equal(decoded, vector) {
+		t.Errorf("got %v, want %v", decoded, vector)
+	}
+}
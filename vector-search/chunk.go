@@ -0,0 +1,139 @@
+package vector_search
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// ChunkChars measures chunks in characters.
+	ChunkChars = "chars"
+	// ChunkTokens measures chunks in tokens, approximated by words.
+	ChunkTokens = "tokens"
+
+	// SplitParagraphs prefers to end chunks between paragraphs, then
+	// between lines and sentences.
+	SplitParagraphs = "paragraphs"
+	// SplitMarkdown also prefers to end chunks before markdown headings.
+	SplitMarkdown = "markdown"
+)
+
+type ChunkOptions struct {
+	// Size is the maximum length of a chunk, in Unit. Records are embedded
+	// whole when it is 0.
+	Size int
+	// Overlap is how much of the end of a chunk is repeated at the start of
+	// the next one, in Unit. It is capped at half of Size, since a larger
+	// overlap makes every chunk a near copy of the previous one.
+	Overlap int
+	// Unit is ChunkChars (default) or ChunkTokens.
+	Unit string
+	// Split is SplitParagraphs (default) or SplitMarkdown.
+	Split string
+}
+
+type Chunk struct {
+	Text string
+	// Offset is the position of the chunk in the source text, in characters.
+	Offset int
+}
+
+var (
+	tokenPattern   = regexp.MustCompile(`\S+`)
+	headingPattern = regexp.MustCompile(`^#{1,6}\s`)
+)
+
+// chunkText splits text into chunks of at most options.Size units. Each
+// chunk ends at the strongest boundary of its second half, so that
+// paragraphs and sections are only cut when they don't fit.
+func chunkText(text string, options ChunkOptions) []Chunk {
+	// Offsets count the leading whitespace that is trimmed.
+	lead := utf8.RuneCountInString(text) - utf8.RuneCountInString(strings.TrimLeftFunc(text, unicode.IsSpace))
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	if options.Size <= 0 {
+		return []Chunk{{Text: text, Offset: lead}}
+	}
+
+	// starts and ends are the byte positions of every unit.
+	starts := []int{}
+	ends := []int{}
+	if options.Unit == ChunkTokens {
+		for _, loc := range tokenPattern.FindAllStringIndex(text, -1) {
+			starts = append(starts, loc[0])
+			ends = append(ends, loc[1])
+		}
+	} else {
+		for i, r := range text {
+			starts = append(starts, i)
+			ends = append(ends, i+utf8.RuneLen(r))
+		}
+	}
+
+	overlap := min(max(options.Overlap, 0), options.Size/2)
+	chunks := []Chunk{}
+	for start := 0; start < len(starts); {
+		end := min(start+options.Size, len(starts))
+		if end < len(starts) {
+			best, strength := end, 0
+			for i := end; i > start+options.Size/2; i-- {
+				if s := boundaryStrength(text, starts[i], options.Split); s > strength {
+					best, strength = i, s
+				}
+			}
+			end = best
+		}
+
+		chunk := text[starts[start]:ends[end-1]]
+		trimmed := strings.TrimLeft(chunk, " \t\r\n")
+		offset := lead + utf8.RuneCountInString(text[:starts[start]]) + utf8.RuneCountInString(chunk) - utf8.RuneCountInString(trimmed)
+		if trimmed = strings.TrimSpace(trimmed); trimmed != "" {
+			chunks = append(chunks, Chunk{Text: trimmed, Offset: offset})
+		}
+
+		if end == len(starts) {
+			break
+		}
+		next := max(end-overlap, start+1)
+		for next < end && !isWordStart(text, starts[next]) {
+			next++
+		}
+		start = next
+	}
+	return chunks
+}
+
+func isWordStart(text string, pos int) bool {
+	r, _ := utf8.DecodeLastRuneInString(text[:pos])
+	return pos == 0 || unicode.IsSpace(r)
+}
+
+// boundaryStrength rates the position pos of text as the end of a chunk:
+// 3 before a markdown heading, 2 between paragraphs, 1 between lines or
+// sentences and 0 elsewhere.
+func boundaryStrength(text string, pos int, split string) int {
+	before := text[:pos]
+	trimmed := strings.TrimRight(before, " \t\r")
+	newlines := 0
+	for strings.HasSuffix(trimmed, "\n") {
+		newlines++
+		trimmed = strings.TrimRight(trimmed[:len(trimmed)-1], " \t\r")
+	}
+	if newlines > 0 && split == SplitMarkdown && headingPattern.MatchString(text[pos:]) {
+		return 3
+	}
+	if newlines > 1 {
+		return 2
+	}
+	if newlines == 1 {
+		return 1
+	}
+	if len(trimmed) > 0 && len(trimmed) < len(before) && strings.ContainsAny(trimmed[len(trimmed)-1:], ".!?") {
+		return 1
+	}
+	return 0
+}
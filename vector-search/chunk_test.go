@@ -0,0 +1,151 @@
+package vector_search
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		options ChunkOptions
+		chunks  []Chunk
+	}{
+		{
+			name:    "empty",
+			text:    "  \n ",
+			options: ChunkOptions{Size: 10},
+			chunks:  nil,
+		},
+		{
+			name:    "whole record",
+			text:    "  padded text  ",
+			options: ChunkOptions{},
+			chunks:  []Chunk{{Text: "padded text", Offset: 2}},
+		},
+		{
+			name:    "leading whitespace",
+			text:    "\n  one two three",
+			options: ChunkOptions{Size: 8},
+			chunks: []Chunk{
+				{Text: "one two", Offset: 3},
+				{Text: "three", Offset: 11},
+			},
+		},
+		{
+			name:    "chars",
+			text:    "one two three four five six",
+			options: ChunkOptions{Size: 10},
+			chunks: []Chunk{
+				{Text: "one two th", Offset: 0},
+				{Text: "ree four f", Offset: 10},
+				{Text: "ive six", Offset: 20},
+			},
+		},
+		{
+			name:    "chars with overlap",
+			text:    "one two three four five six",
+			options: ChunkOptions{Size: 10, Overlap: 4},
+			chunks: []Chunk{
+				{Text: "one two th", Offset: 0},
+				{Text: "three four", Offset: 8},
+				{Text: "four five", Offset: 14},
+				{Text: "six", Offset: 24},
+			},
+		},
+		{
+			name:    "overlap capped at half of the size",
+			text:    "one two three four five six",
+			options: ChunkOptions{Size: 10, Overlap: 100},
+			chunks: []Chunk{
+				{Text: "one two th", Offset: 0},
+				{Text: "three four", Offset: 8},
+				{Text: "four five", Offset: 14},
+				{Text: "five six", Offset: 19},
+			},
+		},
+		{
+			name:    "overlap of a single word",
+			text:    "Hello",
+			options: ChunkOptions{Size: 2, Overlap: 2},
+			chunks: []Chunk{
+				{Text: "He", Offset: 0},
+				{Text: "ll", Offset: 2},
+				{Text: "o", Offset: 4},
+			},
+		},
+		{
+			name:    "tokens with overlap",
+			text:    "one two three four five six",
+			options: ChunkOptions{Size: 3, Overlap: 1, Unit: ChunkTokens},
+			chunks: []Chunk{
+				{Text: "one two three", Offset: 0},
+				{Text: "three four five", Offset: 8},
+				{Text: "five six", Offset: 19},
+			},
+		},
+		{
+			name:    "paragraphs",
+			text:    "First paragraph.\n\nSecond one here.",
+			options: ChunkOptions{Size: 24},
+			chunks: []Chunk{
+				{Text: "First paragraph.", Offset: 0},
+				{Text: "Second one here.", Offset: 18},
+			},
+		},
+		{
+			name:    "markdown headings",
+			text:    "Some intro text here\n# Heading\nBody of the section",
+			options: ChunkOptions{Size: 30, Split: SplitMarkdown},
+			chunks: []Chunk{
+				{Text: "Some intro text here", Offset: 0},
+				{Text: "# Heading\nBody of the section", Offset: 21},
+			},
+		},
+		{
+			name:    "unicode offsets in characters",
+			text:    "Ünïcödé wörds hère ànd thérè",
+			options: ChunkOptions{Size: 12, Overlap: 5},
+			chunks: []Chunk{
+				{Text: "Ünïcödé wörd", Offset: 0},
+				{Text: "wörds hère à", Offset: 8},
+				{Text: "ànd thérè", Offset: 19},
+			},
+		},
+		{
+			name:    "text without spaces",
+			text:    "日本語のテキストを分割する",
+			options: ChunkOptions{Size: 5, Overlap: 2},
+			chunks: []Chunk{
+				{Text: "日本語のテ", Offset: 0},
+				{Text: "キストを分", Offset: 5},
+				{Text: "割する", Offset: 10},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := chunkText(test.text, test.options)
+			if !slices.Equal(chunks, test.chunks) {
+				t.Fatalf("got %q, want %q", chunks, test.chunks)
+			}
+			runes := []rune(test.text)
+			for _, chunk := range chunks {
+				length := utf8.RuneCountInString(chunk.Text)
+				if test.options.Unit == ChunkChars || test.options.Unit == "" {
+					if test.options.Size > 0 && length > test.options.Size {
+						t.Errorf("%q is longer than %d characters", chunk.Text, test.options.Size)
+					}
+				} else if words := len(strings.Fields(chunk.Text)); words > test.options.Size {
+					t.Errorf("%q is longer than %d tokens", chunk.Text, test.options.Size)
+				}
+				if chunk.Offset+length > len(runes) || string(runes[chunk.Offset:chunk.Offset+length]) != chunk.Text {
+					t.Errorf("%q isn't at offset %d of the text", chunk.Text, chunk.Offset)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package vector_search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Distance metrics of the vec0 table of a collection.
+const (
+	DistanceCosine = "cosine"
+	DistanceL2     = "L2"
+	DistanceL1     = "L1"
+)
+
+// configureDistance checks the DistanceMetric of the collection, L2 by
+// default.
+func configureDistance(config *VectorCollection) error {
+	switch strings.ToLower(config.DistanceMetric) {
+	case "", "l2":
+		config.DistanceMetric = DistanceL2
+	case "l1":
+		config.DistanceMetric = DistanceL1
+	case "cosine":
+		config.DistanceMetric = DistanceCosine
+	default:
+		return fmt.Errorf("%s has an unknown distance metric %q, use cosine, L2 or L1", config.Name, config.DistanceMetric)
+	}
+	return nil
+}
+
+// distanceOption is the distance_metric option of the vector column, empty
+// for the default L2.
+func distanceOption(metric string) string {
+	if metric == DistanceL2 {
+		return ""
+	}
+	return " distance_metric=" + metric
+}
+
+// similarity turns a distance into a score that grows with the similarity:
+// the cosine similarity, between -1 and 1, or 1 / (1 + distance), between 0
+// and 1, for L2 and L1.
+func similarity(metric string, distance float64) float64 {
+	if metric == DistanceCosine {
+		return 1 - distance
+	}
+	return 1 / (1 + distance)
+}
@@ -0,0 +1,22 @@
+package vector_search
+
+import "context"
+
+// TaskType tells the embedder whether texts are stored or searched for, which
+// some models embed differently.
+type TaskType string
+
+const (
+	TaskTypeDocument TaskType = "document"
+	TaskTypeQuery    TaskType = "query"
+)
+
+// Embedder turns texts into vectors for a VectorCollection.
+type Embedder interface {
+	// Embed returns one vector of Dimensions() values per text, in order.
+	Embed(ctx context.Context, texts []string, taskType TaskType) ([][]float32, error)
+	// Dimensions is the length of the vectors returned by Embed.
+	Dimensions() int
+	// ModelID identifies the model, eg. "text-embedding-004".
+	ModelID() string
+}
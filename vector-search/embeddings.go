@@ -0,0 +1,516 @@
+package vector_search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Every chunk of a record is a row of <name>_chunks, and its vector is the
+// row of <name>_embeddings with the same id.
+
+var (
+	// EmbedBatchSize is the maximum number of texts per Embed call.
+	EmbedBatchSize = 100
+	// ChunkOverfetch is how many chunks are searched per requested record,
+	// since the best chunks often belong to the same records.
+	ChunkOverfetch = 4
+	// MaxChunkMatches is the largest k accepted by vec0.
+	MaxChunkMatches = 4096
+)
+
+var dimensionsPattern = regexp.MustCompile(`embedding (float|int8|bit)\[(\d+)\]`)
+
+type chunkMatch struct {
+	Record   string  `db:"record"`
+	Text     string  `db:"text"`
+	Offset   int     `db:"start"`
+	Distance float64 `db:"distance"`
+	// Vector is the full vector of the chunk in quantized collections.
+	Vector []byte `db:"vector"`
+}
+
+// embed runs the embedder of the collection and checks that every vector
+// has the declared dimensions.
+func embed(ctx context.Context, config VectorCollection, texts []string, taskType TaskType) ([][]float32, error) {
+	vectors, err := config.Embedder.Embed(ctx, texts, taskType)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d texts", config.Model, len(vectors), len(texts))
+	}
+	for _, vector := range vectors {
+		if len(vector) != config.Dimensions {
+			return nil, fmt.Errorf("%s returned %d dimensions, %s expects %d", config.Model, len(vector), config.Name, config.Dimensions)
+		}
+	}
+	return vectors, nil
+}
+
+// embedBatches embeds texts in batches of EmbedBatchSize. Texts are looked
+// up in the embedding cache first, and repeated texts are embedded once.
+func embedBatches(ctx context.Context, app *pocketbase.PocketBase, config VectorCollection, texts []string, taskType TaskType) ([][]float32, error) {
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = textHash(text)
+	}
+	cached, err := cachedVectors(app, config, taskType, hashes)
+	if err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+		cached = map[string][]float32{}
+	}
+
+	missing := []string{}
+	missingHashes := []string{}
+	seen := map[string]bool{}
+	for i, text := range texts {
+		if _, ok := cached[hashes[i]]; ok || seen[hashes[i]] {
+			continue
+		}
+		seen[hashes[i]] = true
+		missing = append(missing, text)
+		missingHashes = append(missingHashes, hashes[i])
+	}
+	embedded := [][]float32{}
+	for start := 0; start < len(missing); start += EmbedBatchSize {
+		batch, err := embed(ctx, config, missing[start:min(start+EmbedBatchSize, len(missing))], taskType)
+		if err != nil {
+			return nil, err
+		}
+		embedded = append(embedded, batch...)
+	}
+	if err := cacheVectors(app, config, taskType, missingHashes, embedded); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
+	}
+	for i, hash := range missingHashes {
+		cached[hash] = embedded[i]
+	}
+
+	vectors := make([][]float32, len(texts))
+	for i, hash := range hashes {
+		vectors[i] = cached[hash]
+	}
+	return vectors, nil
+}
+
+// createEmbeddingsTable creates the vec0 table of the collection, or checks
+// that the existing one has the configured dimensions. An existing table
+// with other columns is rebuilt with its vectors.
+func createEmbeddingsTable(app *pocketbase.PocketBase, config VectorCollection) error {
+	target := config.Name
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return err
+	}
+	columns, err := embeddingColumns(config, collection)
+	if err != nil {
+		return err
+	}
+	existing, err := embeddingsTable(app, target)
+	if err != nil {
+		return err
+	}
+	if existing == "" {
+		stmt := createEmbeddingsStmt(target, columns)
+		app.Logger().Info(stmt)
+		_, err := app.DB().NewQuery(stmt).Execute()
+		return err
+	}
+
+	matches := dimensionsPattern.FindStringSubmatch(existing)
+	if matches == nil {
+		return fmt.Errorf("can't read the dimensions of %s_embeddings", target)
+	}
+	if dimensions, _ := strconv.Atoi(matches[2]); dimensions != config.Dimensions {
+		return fmt.Errorf(
+			"%s_embeddings stores %d dimensions but %s is configured for %d (%s), drop the table to re-embed the collection",
+			target, dimensions, target, config.Dimensions, config.Model,
+		)
+	}
+	if !slices.Equal(tableColumns(existing), columns) {
+		return rebuildEmbeddingsTable(app, config, collection, columns, matches[1] == "float")
+	}
+	return nil
+}
+
+// embeddingColumns are the column definitions of the vec0 table of the
+// collection.
+func embeddingColumns(config VectorCollection, collection *models.Collection) ([]string, error) {
+	metadata, err := metadataColumns(config, collection)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{
+		"id INTEGER PRIMARY KEY AUTOINCREMENT",
+		vectorColumn(config),
+	}
+	return append(columns, metadata...), nil
+}
+
+func createEmbeddingsStmt(target string, columns []string) string {
+	return "CREATE VIRTUAL TABLE " + target + "_embeddings using vec0( " + strings.Join(columns, ", ") + " );"
+}
+
+// embeddingsTable reads the definition of the existing vec0 table of the
+// collection, or "" when there is none.
+func embeddingsTable(app *pocketbase.PocketBase, target string) (string, error) {
+	type Meta struct {
+		Sql string `db:"sql"`
+	}
+	items := []*Meta{}
+	err := app.DB().
+		NewQuery("SELECT sql FROM sqlite_master WHERE type='table' AND name = {:table_name};").
+		Bind(dbx.Params{"table_name": target + "_embeddings"}).
+		All(&items)
+	if err != nil || len(items) == 0 {
+		return "", err
+	}
+	return items[0].Sql, nil
+}
+
+// tableColumns splits the column definitions of a CREATE VIRTUAL TABLE
+// statement.
+func tableColumns(stmt string) []string {
+	start := strings.Index(stmt, "(")
+	end := strings.LastIndex(stmt, ")")
+	if start < 0 || end < start {
+		return nil
+	}
+	columns := []string{}
+	for _, column := range strings.Split(stmt[start+1:end], ",") {
+		columns = append(columns, strings.Join(strings.Fields(column), " "))
+	}
+	return columns
+}
+
+// rebuildEmbeddingsTable recreates the vec0 table of the collection with
+// new columns. vec0 tables can't be altered, so the vectors are copied to a
+// plain table and back, with the metadata of their records. Quantized
+// vectors are recreated from the full vectors of the chunks.
+func rebuildEmbeddingsTable(app *pocketbase.PocketBase, config VectorCollection, collection *models.Collection, columns []string, full bool) error {
+	target := config.Name
+	names := []string{"id", "embedding"}
+	values := []string{"b.id", quantizeExpr(config.Quantization, "COALESCE(c.vector, b.embedding)")}
+	names = append(names, config.FilterFields...)
+	values = append(values, metadataSelect(collection, config)...)
+	stmts := []string{
+		"DROP TABLE IF EXISTS " + target + "_embeddings_rebuild;",
+		"CREATE TABLE " + target + "_embeddings_rebuild AS SELECT id, embedding FROM " + target + "_embeddings;",
+	}
+	if full && config.Quantization != "" {
+		stmts = append(stmts,
+			"UPDATE "+target+"_chunks SET vector = "+
+				"(SELECT embedding FROM "+target+"_embeddings_rebuild b WHERE b.id = "+target+"_chunks.id) "+
+				"WHERE vector IS NULL;",
+		)
+	}
+	stmts = append(stmts,
+		"DROP TABLE "+target+"_embeddings;",
+		createEmbeddingsStmt(target, columns),
+		"INSERT INTO "+target+"_embeddings ("+strings.Join(names, ", ")+") "+
+			"SELECT "+strings.Join(values, ", ")+" FROM "+target+"_embeddings_rebuild b "+
+			"LEFT JOIN "+target+"_chunks c ON c.id = b.id "+
+			"LEFT JOIN `"+target+"` r ON r.id = c.record;",
+		"DROP TABLE "+target+"_embeddings_rebuild;",
+	)
+	if config.Quantization == "" {
+		stmts = append(stmts, "UPDATE "+target+"_chunks SET vector = NULL;")
+	}
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for _, stmt := range stmts {
+			app.Logger().Info(stmt)
+			if _, err := txDao.DB().NewQuery(stmt).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// createChunksTable creates the chunk table of the collection. The vectors
+// of collections that predate it are kept as one chunk per record.
+func createChunksTable(app *pocketbase.PocketBase, config VectorCollection) error {
+	target := config.Name
+	type Meta struct {
+		Name string `db:"name"`
+	}
+	items := []*Meta{}
+	err := app.DB().
+		NewQuery("SELECT name FROM sqlite_master WHERE type='table' AND name = {:table_name};").
+		Bind(dbx.Params{"table_name": target + "_chunks"}).
+		All(&items)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		return addChunkVectors(app, target)
+	}
+
+	stmts := []string{
+		"CREATE TABLE " + target + "_chunks (" +
+			"  id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"  record TEXT NOT NULL," +
+			"  chunk INTEGER NOT NULL DEFAULT 0," +
+			"  start INTEGER NOT NULL DEFAULT 0," +
+			"  text TEXT NOT NULL DEFAULT ''," +
+			"  vector BLOB" +
+			");",
+		"CREATE INDEX idx_" + target + "_chunks_record ON " + target + "_chunks (record);",
+	}
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return err
+	}
+	if collection.Schema.GetFieldByName("vector_id") != nil {
+		stmts = append(stmts,
+			"INSERT INTO "+target+"_chunks (id, record) "+
+				"SELECT vector_id, id FROM `"+target+"` WHERE vector_id > 0;",
+		)
+	}
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for _, stmt := range stmts {
+			app.Logger().Info(stmt)
+			if _, err := txDao.DB().NewQuery(stmt).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addChunkVectors adds the column of the full vectors of quantized
+// collections to the chunk tables that predate it.
+func addChunkVectors(app *pocketbase.PocketBase, target string) error {
+	count := 0
+	err := app.DB().
+		NewQuery("SELECT COUNT(*) FROM pragma_table_info({:table_name}) WHERE name = 'vector';").
+		Bind(dbx.Params{"table_name": target + "_chunks"}).
+		Row(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	stmt := "ALTER TABLE " + target + "_chunks ADD COLUMN vector BLOB;"
+	app.Logger().Info(stmt)
+	_, err = app.DB().NewQuery(stmt).Execute()
+	return err
+}
+
+// saveChunks embeds the chunks of a record and replaces its previous ones.
+func saveChunks(ctx context.Context, app *pocketbase.PocketBase, config VectorCollection, record *models.Record, hash string, chunks []Chunk) error {
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+	vectors, err := embedBatches(ctx, app, config, texts, TaskTypeDocument)
+	if err != nil {
+		return err
+	}
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		return storeChunks(txDao.DB(), config, record.Id, hash, metadataValues(config, record), chunks, vectors)
+	})
+}
+
+// storeChunks replaces the chunks of a record with already embedded ones,
+// and saves the hash of their source text.
+func storeChunks(db dbx.Builder, config VectorCollection, recordId string, hash string, metadata dbx.Params, chunks []Chunk, vectors [][]float32) error {
+	target := config.Name
+	if err := deleteChunks(db, target, recordId); err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		// Quantized collections keep the full vectors to rescore them.
+		var fullVector any
+		if config.Quantization != "" {
+			fullVector = encodeVector(vectors[i])
+		}
+		res, err := db.
+			NewQuery("INSERT INTO " + target + "_chunks (record, chunk, start, text, vector) VALUES ({:record}, {:chunk}, {:start}, {:text}, {:vector});").
+			Bind(dbx.Params{
+				"record": recordId,
+				"chunk":  i,
+				"start":  chunk.Offset,
+				"text":   chunk.Text,
+				"vector": fullVector,
+			}).
+			Execute()
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		vector, err := json.Marshal(vectors[i])
+		if err != nil {
+			return err
+		}
+		columns := []string{"id", "embedding"}
+		values := []string{"{:id}", quantizeExpr(config.Quantization, "{:embedding}")}
+		params := dbx.Params{
+			"id":        id,
+			"embedding": string(vector),
+		}
+		for _, name := range config.FilterFields {
+			columns = append(columns, name)
+			values = append(values, "{:meta_"+name+"}")
+			params["meta_"+name] = metadata[name]
+		}
+		_, err = db.
+			NewQuery("INSERT INTO " + target + "_embeddings (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(values, ", ") + ");").
+			Bind(params).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return saveHash(db, target, recordId, hash)
+}
+
+// updateMetadata copies the FilterFields of a record to the vectors of its
+// chunks, when they changed but not the embedded text.
+func updateMetadata(db dbx.Builder, config VectorCollection, record *models.Record) error {
+	if len(config.FilterFields) == 0 {
+		return nil
+	}
+	target := config.Name
+	ids := []int64{}
+	err := db.
+		NewQuery("SELECT id FROM " + target + "_chunks WHERE record = {:record};").
+		Bind(dbx.Params{"record": record.Id}).
+		Column(&ids)
+	if err != nil {
+		return err
+	}
+	metadata := metadataValues(config, record)
+	for _, id := range ids {
+		_, err := db.Update(target+"_embeddings", metadata, dbx.HashExp{"id": id}).Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChunks deletes the chunks of a record, their vectors and its hash.
+func deleteChunks(db dbx.Builder, target string, recordId string) error {
+	ids := []int64{}
+	err := db.
+		NewQuery("SELECT id FROM " + target + "_chunks WHERE record = {:record};").
+		Bind(dbx.Params{"record": recordId}).
+		Column(&ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err := db.
+			NewQuery("DELETE FROM " + target + "_embeddings WHERE id = {:id};").
+			Bind(dbx.Params{"id": id}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.
+		NewQuery("DELETE FROM " + target + "_chunks WHERE record = {:record};").
+		Bind(dbx.Params{"record": recordId}).
+		Execute()
+	if err != nil {
+		return err
+	}
+	_, err = db.
+		NewQuery("DELETE FROM " + target + "_hashes WHERE record = {:record};").
+		Bind(dbx.Params{"record": recordId}).
+		Execute()
+	return err
+}
+
+// searchChunks returns the k records nearest to vector that visible
+// returns, each with its best chunk, nearest first. Hidden records don't
+// count toward k. where filters the metadata columns of the vectors.
+func searchChunks(app *pocketbase.PocketBase, config VectorCollection, vector []float32, k int, where string, whereParams dbx.Params, visible func(ids []string) (map[string]*models.Record, error)) ([]*chunkMatch, map[string]*models.Record, error) {
+	target := config.Name
+	embedding, err := json.Marshal(vector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmt := "SELECT c.record AS record, c.text AS text, c.start AS start, c.vector AS vector, distance "
+	stmt += "FROM " + target + "_embeddings "
+	stmt += "LEFT JOIN " + target + "_chunks c ON c.id = " + target + "_embeddings.id "
+	stmt += "WHERE embedding MATCH " + quantizeExpr(config.Quantization, "{:embedding}") + " "
+	stmt += "AND k = {:k} "
+	if where != "" {
+		stmt += "AND " + where + " "
+	}
+	stmt += "ORDER BY distance;"
+
+	records := map[string]*models.Record{}
+	checked := map[string]bool{}
+	fetch := k * ChunkOverfetch
+	if config.Quantization != "" {
+		fetch *= config.Rescore
+	}
+	fetch = min(fetch, MaxChunkMatches)
+	for {
+		params := dbx.Params{
+			"embedding": string(embedding),
+			"k":         fetch,
+		}
+		for name, value := range whereParams {
+			params[name] = value
+		}
+		rows := []*chunkMatch{}
+		err := app.DB().
+			NewQuery(stmt).
+			Bind(params).
+			All(&rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		fetched := len(rows)
+		if config.Quantization != "" {
+			rows = rescore(config, vector, rows)
+		}
+
+		unchecked := []string{}
+		for _, row := range rows {
+			if row.Record != "" && !checked[row.Record] {
+				checked[row.Record] = true
+				unchecked = append(unchecked, row.Record)
+			}
+		}
+		if len(unchecked) > 0 {
+			found, err := visible(unchecked)
+			if err != nil {
+				return nil, nil, err
+			}
+			for id, record := range found {
+				records[id] = record
+			}
+		}
+
+		matches := []*chunkMatch{}
+		seen := map[string]bool{}
+		for _, row := range rows {
+			if records[row.Record] == nil || seen[row.Record] {
+				continue
+			}
+			seen[row.Record] = true
+			matches = append(matches, row)
+		}
+		if len(matches) >= k || fetched < fetch || fetch >= MaxChunkMatches {
+			return matches[:min(k, len(matches))], records, nil
+		}
+		fetch = min(fetch*2, MaxChunkMatches)
+	}
+}
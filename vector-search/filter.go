@@ -0,0 +1,192 @@
+package vector_search
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ganigeorgiev/fexpr"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// The FilterFields of a collection are copied into metadata columns of its
+// vec0 table, so that the terms of a filter on them are applied by the KNN
+// query itself. The whole filter is always applied to the records as well.
+
+// MaxFilterFields is the maximum number of vec0 metadata columns.
+const MaxFilterFields = 16
+
+// reservedColumns can't be used as FilterFields.
+var reservedColumns = []string{"id", "rowid", "embedding", "distance", "k"}
+
+// adminOnlyFilterFields can't be used in filters by users and guests, as in
+// the records list API.
+var adminOnlyFilterFields = []string{"@collection.", "@request."}
+
+const (
+	metadataText    = "text"
+	metadataFloat   = "float"
+	metadataBoolean = "boolean"
+)
+
+// metadataColumns are the vec0 column definitions of the FilterFields,
+// eg. "category text".
+func metadataColumns(config VectorCollection, collection *models.Collection) ([]string, error) {
+	if len(config.FilterFields) > MaxFilterFields {
+		return nil, fmt.Errorf("%s has %d FilterFields, vec0 supports up to %d", config.Name, len(config.FilterFields), MaxFilterFields)
+	}
+	columns := []string{}
+	for _, name := range config.FilterFields {
+		kind, err := metadataType(collection, name)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, name+" "+kind)
+	}
+	return columns, nil
+}
+
+// metadataType is the vec0 type of a filter field. Only fields with a single
+// text, number or bool value can be stored.
+func metadataType(collection *models.Collection, name string) (string, error) {
+	if slices.Contains(reservedColumns, strings.ToLower(name)) {
+		return "", fmt.Errorf("%s can't be a filter field of %s", name, collection.Name)
+	}
+	field := collection.Schema.GetFieldByName(name)
+	if field == nil {
+		return "", fmt.Errorf("%s has no field %s to filter by", collection.Name, name)
+	}
+	if options, ok := field.Options.(schema.MultiValuer); ok && options.IsMultiple() {
+		return "", fmt.Errorf("%s.%s has multiple values and can't be a filter field", collection.Name, name)
+	}
+	switch field.Type {
+	case schema.FieldTypeBool:
+		return metadataBoolean, nil
+	case schema.FieldTypeNumber:
+		return metadataFloat, nil
+	case schema.FieldTypeText, schema.FieldTypeEmail, schema.FieldTypeUrl, schema.FieldTypeDate,
+		schema.FieldTypeSelect, schema.FieldTypeRelation:
+		return metadataText, nil
+	}
+	return "", fmt.Errorf("%s.%s is a %s field and can't be a filter field", collection.Name, name, field.Type)
+}
+
+// metadataValues are the values of the FilterFields of a record.
+func metadataValues(config VectorCollection, record *models.Record) dbx.Params {
+	values := dbx.Params{}
+	for _, name := range config.FilterFields {
+		field := record.Collection().Schema.GetFieldByName(name)
+		if field == nil {
+			continue
+		}
+		switch field.Type {
+		case schema.FieldTypeBool:
+			values[name] = record.GetBool(name)
+		case schema.FieldTypeNumber:
+			values[name] = record.GetFloat(name)
+		default:
+			values[name] = record.GetString(name)
+		}
+	}
+	return values
+}
+
+// metadataSelect selects the values of the FilterFields from the record
+// table aliased r, with the type of their metadata column.
+func metadataSelect(collection *models.Collection, config VectorCollection) []string {
+	values := []string{}
+	for _, name := range config.FilterFields {
+		kind, _ := metadataType(collection, name)
+		switch kind {
+		case metadataBoolean:
+			values = append(values, "COALESCE(r."+name+", FALSE)")
+		case metadataFloat:
+			values = append(values, "CAST(COALESCE(r."+name+", 0) AS REAL)")
+		default:
+			values = append(values, "CAST(COALESCE(r."+name+", '') AS TEXT)")
+		}
+	}
+	return values
+}
+
+// checkFilter rejects the filters that only admins can use.
+func checkFilter(filter string, info *models.RequestInfo) error {
+	if info == nil || info.Admin != nil {
+		return nil
+	}
+	for _, field := range adminOnlyFilterFields {
+		if strings.Contains(filter, field) {
+			return apis.NewForbiddenError("Only admins can filter by "+field, nil)
+		}
+	}
+	return nil
+}
+
+// metadataFilter converts the terms of a filter that compare a filter field
+// with a literal into conditions on the metadata columns. Only filters that
+// join their terms with && are converted, and the other terms are left to
+// the records query.
+func metadataFilter(collection *models.Collection, config VectorCollection, filter string) (string, dbx.Params) {
+	params := dbx.Params{}
+	if filter == "" || len(config.FilterFields) == 0 {
+		return "", params
+	}
+	groups, err := fexpr.Parse(filter)
+	if err != nil {
+		return "", params
+	}
+	for _, group := range groups {
+		if group.Join == fexpr.JoinOr {
+			return "", params
+		}
+	}
+
+	conditions := []string{}
+	for _, group := range groups {
+		expr, ok := group.Item.(fexpr.Expr)
+		if !ok || expr.Left.Type != fexpr.TokenIdentifier || !slices.Contains(config.FilterFields, expr.Left.Literal) {
+			continue
+		}
+		switch expr.Op {
+		case fexpr.SignEq, fexpr.SignNeq, fexpr.SignLt, fexpr.SignLte, fexpr.SignGt, fexpr.SignGte:
+		default:
+			continue
+		}
+		kind, err := metadataType(collection, expr.Left.Literal)
+		if err != nil {
+			continue
+		}
+		value, ok := metadataLiteral(kind, expr.Right)
+		if !ok {
+			continue
+		}
+		param := "filter" + strconv.Itoa(len(conditions))
+		conditions = append(conditions, config.Name+"_embeddings."+expr.Left.Literal+" "+string(expr.Op)+" {:"+param+"}")
+		params[param] = value
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// metadataLiteral is the value of a literal compared with a metadata column
+// of the given type, when the comparison means the same for the records.
+func metadataLiteral(kind string, token fexpr.Token) (any, bool) {
+	switch {
+	case kind == metadataText && token.Type == fexpr.TokenText:
+		return token.Literal, true
+	case kind == metadataFloat && token.Type == fexpr.TokenNumber:
+		value, err := strconv.ParseFloat(token.Literal, 64)
+		return value, err == nil
+	case kind == metadataBoolean && token.Type == fexpr.TokenIdentifier:
+		switch strings.ToLower(token.Literal) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	return nil, false
+}
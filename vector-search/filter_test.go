@@ -0,0 +1,117 @@
+package vector_search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	collection := &models.Collection{
+		Name: "posts",
+		Schema: schema.NewSchema(
+			&schema.SchemaField{Name: "category", Type: schema.FieldTypeText},
+			&schema.SchemaField{Name: "published", Type: schema.FieldTypeBool},
+			&schema.SchemaField{Name: "rating", Type: schema.FieldTypeNumber},
+			&schema.SchemaField{Name: "author", Type: schema.FieldTypeText},
+		),
+	}
+	config := VectorCollection{
+		Name:         "posts",
+		FilterFields: []string{"category", "published", "rating"},
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		where  string
+		params dbx.Params
+	}{
+		{
+			name:   "empty",
+			filter: "",
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "single term",
+			filter: `category = "news"`,
+			where:  "posts_embeddings.category = {:filter0}",
+			params: dbx.Params{"filter0": "news"},
+		},
+		{
+			name:   "typed terms",
+			filter: `published = true && rating >= 4`,
+			where:  "posts_embeddings.published = {:filter0} AND posts_embeddings.rating >= {:filter1}",
+			params: dbx.Params{"filter0": true, "filter1": 4.0},
+		},
+		{
+			name:   "fields that aren't filter fields are left to the rules",
+			filter: `author = "ada" && category != "news"`,
+			where:  "posts_embeddings.category != {:filter0}",
+			params: dbx.Params{"filter0": "news"},
+		},
+		{
+			name:   "or",
+			filter: `category = "news" || published = true`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "or after and",
+			filter: `rating > 2 && category = "news" || published = true`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "nested group is skipped",
+			filter: `(category = "news" || category = "blog") && published = true`,
+			where:  "posts_embeddings.published = {:filter0}",
+			params: dbx.Params{"filter0": true},
+		},
+		{
+			name:   "nested and group is skipped",
+			filter: `(category = "news" && rating > 2)`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "unsupported operators",
+			filter: `category ~ "ne" && category ?= "news"`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "mistyped literals",
+			filter: `rating = "high" && published = "yes" && category = 3`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "field compared with a field",
+			filter: `category = author`,
+			where:  "",
+			params: dbx.Params{},
+		},
+		{
+			name:   "invalid filter",
+			filter: `category = `,
+			where:  "",
+			params: dbx.Params{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			where, params := metadataFilter(collection, config, test.filter)
+			if where != test.where {
+				t.Errorf("got %q, want %q", where, test.where)
+			}
+			if !reflect.DeepEqual(params, test.params) {
+				t.Errorf("got params %v, want %v", params, test.params)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package vector_search
 
 import (
 	"context"
+	"fmt"
 	"os"
 
 	"github.com/google/generative-ai-go/genai"
@@ -18,18 +19,59 @@ func createGoogleAiClient() (*genai.Client, error) {
 	return client, nil
 }
 
-func googleAiEmbedContent(client *genai.Client, taskType genai.TaskType, title string, parts ...genai.Part) ([]float32, error) {
-	ctx := context.Background()
-	model := googleAiEmbeddingModel(client)
-	model.TaskType = taskType
-	res, err := model.EmbedContentWithTitle(ctx, title, parts...)
+// GoogleAiEmbedder embeds texts with the Gemini API.
+type GoogleAiEmbedder struct {
+	Client *genai.Client
+	// Model defaults to "text-embedding-004".
+	Model string
+	// Dims defaults to 768.
+	Dims int
+}
+
+// NewGoogleAiEmbedder creates a text-embedding-004 embedder with the
+// GOOGLE_AI_API_KEY environment variable.
+func NewGoogleAiEmbedder() (*GoogleAiEmbedder, error) {
+	client, err := createGoogleAiClient()
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleAiEmbedder{Client: client}, nil
+}
+
+func (g *GoogleAiEmbedder) Embed(ctx context.Context, texts []string, taskType TaskType) ([][]float32, error) {
+	model := g.Client.EmbeddingModel(g.ModelID())
+	model.TaskType = genai.TaskTypeRetrievalDocument
+	if taskType == TaskTypeQuery {
+		model.TaskType = genai.TaskTypeRetrievalQuery
+	}
+	batch := model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+	res, err := model.BatchEmbedContents(ctx, batch)
 	if err != nil {
 		return nil, err
 	}
-	return res.Embedding.Values, nil
+	if len(res.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("google ai returned %d embeddings for %d texts", len(res.Embeddings), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for i, embedding := range res.Embeddings {
+		vectors[i] = embedding.Values
+	}
+	return vectors, nil
 }
 
-func googleAiEmbeddingModel(client *genai.Client) *genai.EmbeddingModel {
-	em := client.EmbeddingModel("text-embedding-004")
-	return em
+func (g *GoogleAiEmbedder) Dimensions() int {
+	if g.Dims > 0 {
+		return g.Dims
+	}
+	return 768
+}
+
+func (g *GoogleAiEmbedder) ModelID() string {
+	if g.Model != "" {
+		return g.Model
+	}
+	return "text-embedding-004"
 }
@@ -0,0 +1,57 @@
+package vector_search
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+)
+
+// The <name>_hashes table keeps the content hash of the embedded text of
+// every record, so that records are only embedded again when the hash
+// changes, eg. not when an unrelated field is updated.
+
+func createHashesTable(app *pocketbase.PocketBase, target string) error {
+	stmt := "CREATE TABLE IF NOT EXISTS " + target + "_hashes (" +
+		"  record TEXT PRIMARY KEY," +
+		"  hash TEXT NOT NULL" +
+		");"
+	app.Logger().Info(stmt)
+	_, err := app.DB().NewQuery(stmt).Execute()
+	return err
+}
+
+// contentHash covers everything the embeddings of a text depend on: the
+// model, the dimensions and the chunking of the collection, and the text.
+func contentHash(config VectorCollection, text string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%d\x00%+v\x00", config.Model, config.Dimensions, config.Chunking)
+	hash.Write([]byte(text))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// storedHash is the hash of the last embedded text of a record, or "" when
+// it was never embedded.
+func storedHash(db dbx.Builder, target string, recordId string) (string, error) {
+	hash := ""
+	err := db.
+		NewQuery("SELECT hash FROM " + target + "_hashes WHERE record = {:record};").
+		Bind(dbx.Params{"record": recordId}).
+		Row(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+func saveHash(db dbx.Builder, target string, recordId string, hash string) error {
+	_, err := db.
+		NewQuery("INSERT OR REPLACE INTO " + target + "_hashes (record, hash) VALUES ({:record}, {:hash});").
+		Bind(dbx.Params{"record": recordId, "hash": hash}).
+		Execute()
+	return err
+}
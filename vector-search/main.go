@@ -1,10 +1,11 @@
 package vector_search
 
 import (
-	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
 	"github.com/google/generative-ai-go/genai"
@@ -21,38 +22,113 @@ import (
 type VectorCollection struct {
 	Name        string
 	ExtraFields []*schema.SchemaField
+	// Embedder creates the vectors of the collection. Defaults to Google AI
+	// with the GOOGLE_AI_API_KEY environment variable.
+	Embedder Embedder
+	// Model and Dimensions default to the ones of the Embedder. Without an
+	// Embedder they configure the Google AI model, text-embedding-004 and
+	// 768 by default.
+	Model      string
+	Dimensions int
+	// Fields are joined, one paragraph each, into the embedded text.
+	// Defaults to DefaultFields.
+	Fields []string
+	// Template renders the embedded text from the record fields instead,
+	// eg. "{{.name}} — {{.description}} Tags: {{join .tags}}".
+	Template string
+
+	// Chunking splits long texts into several embeddings. Search results
+	// include the best matching chunk of every record.
+	Chunking ChunkOptions
+
+	// FilterFields are stored with the vectors, so that the terms of a
+	// search filter on them are applied by the KNN query instead of after
+	// it. Up to 16 fields with a single text, number or bool value.
+	FilterFields []string
+
+	// DistanceMetric compares the vectors: DistanceCosine, DistanceL2
+	// (default) or DistanceL1. Changing it rebuilds the vec0 table.
+	DistanceMetric string
+
+	// Quantization searches QuantizeInt8 or QuantizeBit vectors instead of
+	// float32 ones, and rescores the Rescore nearest candidates per result
+	// (DefaultRescore) with the full vectors. Changing it rebuilds the vec0
+	// table.
+	Quantization string
+	Rescore      int
+
+	template *template.Template
 }
 
 var ColPrefix = "$$$"
 
 func Init(app *pocketbase.PocketBase, collections ...VectorCollection) error {
 	sqlite_vec.Auto()
-	client, err := createGoogleAiClient()
-	if err != nil {
-		return err
-	}
-	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
-		for _, target := range collections {
-			collection, _ := app.Dao().FindCollectionByNameOrId(target.Name)
-			if collection == nil {
-				err := createCollection(app, target.Name, target.ExtraFields...)
+	var client *genai.Client
+	for i := range collections {
+		if collections[i].Embedder == nil {
+			if client == nil {
+				c, err := createGoogleAiClient()
 				if err != nil {
-					app.Logger().Error(fmt.Sprint(err))
 					return err
 				}
+				client = c
+			}
+			collections[i].Embedder = &GoogleAiEmbedder{
+				Client: client,
+				Model:  collections[i].Model,
+				Dims:   collections[i].Dimensions,
 			}
 		}
+		if err := configureDimensions(&collections[i]); err != nil {
+			return err
+		}
+		if err := parseTemplate(&collections[i]); err != nil {
+			return err
+		}
+		if err := configureDistance(&collections[i]); err != nil {
+			return err
+		}
+		if err := configureQuantization(&collections[i]); err != nil {
+			return err
+		}
+	}
+	app.RootCmd.AddCommand(reindexCommand(app, collections))
+	jobs := newQueue(app, collections)
+	app.OnAfterBootstrap().Add(func(e *core.BootstrapEvent) error {
+		// Records can be saved before serve, eg. by migrations, and their
+		// save hooks enqueue a job.
+		if err := createJobsTable(app); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		return nil
+	})
+	// The save hooks only write to the tables of the plugin once they are
+	// set up.
+	var ready atomic.Bool
+	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
+		if err := setupCollections(app, collections); err != nil {
+			return err
+		}
+		ready.Store(true)
+		jobs.start()
+		return nil
+	})
+	app.OnTerminate().Add(func(e *core.TerminateEvent) error {
+		jobs.stop()
 		return nil
 	})
 	app.OnModelAfterCreate().Add(func(e *core.ModelEvent) error {
 		tbl := e.Model.TableName()
 		for _, target := range collections {
 			if tbl == target.Name {
-				err := modelModify(app, target.Name, client, e)
+				err := enqueue(e.Dao.DB(), target.Name, e.Model.GetId())
 				if err != nil {
 					app.Logger().Error(fmt.Sprint(err))
 					return err
 				}
+				jobs.notify()
 			}
 		}
 		return nil
@@ -61,11 +137,20 @@ func Init(app *pocketbase.PocketBase, collections ...VectorCollection) error {
 		tbl := e.Model.TableName()
 		for _, target := range collections {
 			if tbl == target.Name {
-				err := modelModify(app, target.Name, client, e)
+				// Filters see the new FilterFields right away, not once the
+				// job has embedded the record again.
+				if record, ok := e.Model.(*models.Record); ok && ready.Load() {
+					if err := updateMetadata(e.Dao.DB(), target, record); err != nil {
+						app.Logger().Error(fmt.Sprint(err))
+						return err
+					}
+				}
+				err := enqueue(e.Dao.DB(), target.Name, e.Model.GetId())
 				if err != nil {
 					app.Logger().Error(fmt.Sprint(err))
 					return err
 				}
+				jobs.notify()
 			}
 		}
 		return nil
@@ -74,7 +159,11 @@ func Init(app *pocketbase.PocketBase, collections ...VectorCollection) error {
 		tbl := e.Model.TableName()
 		for _, target := range collections {
 			if tbl == target.Name {
-				err := modelDelete(app, target.Name, e)
+				if err := dequeue(e.Dao.DB(), target.Name, e.Model.GetId()); err != nil {
+					app.Logger().Error(fmt.Sprint(err))
+					return err
+				}
+				err := deleteChunks(e.Dao.DB(), target.Name, e.Model.GetId())
 				if err != nil {
 					app.Logger().Error(fmt.Sprint(err))
 					return err
@@ -97,11 +186,18 @@ func Init(app *pocketbase.PocketBase, collections ...VectorCollection) error {
 	})
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		group := e.Router.Group("/api/collections/:collectionIdOrName/records", apis.ActivityLogger(app))
+		startReindex, reindexProgress := reindexHandlers(app, collections)
+		group.POST("/vector-search/reindex", startReindex, apis.RequireAdminAuth())
+		group.GET("/vector-search/reindex", reindexProgress, apis.RequireAdminAuth())
 		group.GET("/vector-search", func(c echo.Context) error {
-			target := c.PathParam("collectionIdOrName")
-			if _, err := app.Dao().FindCollectionByNameOrId(target); err != nil {
+			collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collectionIdOrName"))
+			if err != nil {
 				app.Logger().Error(fmt.Sprint(err))
-				return err
+				return apis.NewNotFoundError("", err)
+			}
+			config, ok := findVectorCollection(collection.Name, collections...)
+			if !ok {
+				return apis.NewNotFoundError("Vector search is not enabled for "+collection.Name+".", nil)
 			}
 
 			title := c.QueryParam("title")
@@ -110,189 +206,199 @@ func Init(app *pocketbase.PocketBase, collections ...VectorCollection) error {
 			kNum := 5
 			if k != "" {
 				val, err := strconv.Atoi(k)
-				if err == nil {
-					kNum = val
+				if err != nil {
+					return apis.NewBadRequestError("The number of results k must be a number.", err)
 				}
+				kNum = val
+			}
+			if err := checkK(kNum); err != nil {
+				return err
 			}
 
 			if content == "" {
 				return c.NoContent(204)
 			}
+			info := apis.RequestInfo(c)
+			filter := c.QueryParam("filter")
+			if err := checkSearch(collection, info, filter); err != nil {
+				return err
+			}
 
-			vector, err := googleAiEmbedContent(client, genai.TaskTypeRetrievalQuery, title, genai.Text(content))
+			vectors, err := embedBatches(c.Request().Context(), app, config, []string{embeddingText(title, content)}, TaskTypeQuery)
 			if err != nil {
 				return err
 			}
-			jsonVec, err := json.Marshal(vector)
+			items, err := searchRecords(app, collection, config, info, vectors[0], kNum, filter)
 			if err != nil {
+				app.Logger().Error(fmt.Sprint(err))
 				return err
 			}
 
-			stmt := "SELECT v.id, distance, v.content, v.created, v.updated "
-			stmt += "FROM " + target + "_embeddings "
-			stmt += "LEFT JOIN " + target + " v ON v.vector_id = " + target + "_embeddings.id "
-			stmt += "WHERE embedding MATCH {:embedding} "
-			stmt += "AND k = {:k};"
+			// TODO: Paging result
+			return c.JSON(200, items)
 
-			results := []dbx.NullStringMap{}
-			err = app.Dao().DB().
-				NewQuery(stmt).
-				Bind(dbx.Params{
-					"embedding": string(jsonVec),
-					"k":         kNum,
-				}).
-				All(&results)
+		})
+		group.POST("/vector-search", func(c echo.Context) error {
+			collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collectionIdOrName"))
 			if err != nil {
 				app.Logger().Error(fmt.Sprint(err))
-				return err
+				return apis.NewNotFoundError("", err)
+			}
+			config, ok := findVectorCollection(collection.Name, collections...)
+			if !ok {
+				return apis.NewNotFoundError("Vector search is not enabled for "+collection.Name+".", nil)
 			}
-			app.Logger().Info(fmt.Sprint(results))
 
-			c.Response().Header().Set(echo.HeaderContentType, "application/json")
-			items := []map[string]any{}
-			for _, result := range results {
-				m := make(map[string]interface{})
-				for key := range result {
-					val := result[key]
-					value, err := val.Value()
-					if err != nil || !val.Valid {
-						m[key] = nil
-					} else {
-						m[key] = value
-					}
-				}
-				items = append(items, m)
+			// read before Bind, which consumes the request body
+			info := apis.RequestInfo(c)
+			body := struct {
+				Vector []float32 `json:"vector"`
+				K      int       `json:"k"`
+				Filter string    `json:"filter"`
+			}{K: 5}
+			if err := c.Bind(&body); err != nil {
+				return apis.NewBadRequestError("Failed to read the request data.", err)
+			}
+			if len(body.Vector) != config.Dimensions {
+				return apis.NewBadRequestError(fmt.Sprintf("The vector has %d dimensions, %s expects %d.", len(body.Vector), collection.Name, config.Dimensions), nil)
+			}
+			if err := checkK(body.K); err != nil {
+				return err
+			}
+			if err := checkSearch(collection, info, body.Filter); err != nil {
+				return err
 			}
 
-			// TODO: Paging result
+			items, err := searchRecords(app, collection, config, info, body.Vector, body.K, body.Filter)
+			if err != nil {
+				app.Logger().Error(fmt.Sprint(err))
+				return err
+			}
 			return c.JSON(200, items)
-
 		})
 		return nil
 	})
 	return nil
 }
 
-func deleteCollection(app *pocketbase.PocketBase, target string) error {
-	if _, err := app.Dao().DB().
-		NewQuery("DELETE FROM " + target + "_embeddings;").
-		Execute(); err != nil {
-		return err
-	}
-	if _, err := app.Dao().DB().
-		NewQuery("DROP TABLE IF EXISTS " + target + "_embeddings;").
-		Execute(); err != nil {
+// setupCollections creates the collections and tables of the plugin, and
+// checks the dimensions of the existing ones.
+func setupCollections(app *pocketbase.PocketBase, collections []VectorCollection) error {
+	if err := resetJobs(app); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
 		return err
 	}
-	return nil
-}
-
-func modelDelete(app *pocketbase.PocketBase, target string, e *core.ModelEvent) error {
-	_, err := e.Dao.FindRecordById(e.Model.TableName(), e.Model.GetId())
-	if err != nil {
+	if err := createReindexTable(app); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
 		return err
 	}
-	deleteEmbeddingsForRecord(app, target, e)
-	return nil
-}
-
-func modelModify(app *pocketbase.PocketBase, target string, client *genai.Client, e *core.ModelEvent) error {
-	record, err := e.Dao.FindRecordById(e.Model.TableName(), e.Model.GetId())
-	if err != nil {
+	if err := createCacheTable(app); err != nil {
+		app.Logger().Error(fmt.Sprint(err))
 		return err
 	}
-	title := record.GetString("title")
-	content := record.GetString("content")
-
-	if content != "" {
-		result, err := googleAiEmbedContent(client, genai.TaskTypeRetrievalDocument, title, genai.Text(content))
-		if err != nil {
-			return err
-		}
-
-		vector := ""
-		jsonVec, err := json.Marshal(result)
-		if err != nil {
-			vector = "[]"
-		} else {
-			vector = string(jsonVec)
-		}
-
-		deleteEmbeddingsForRecord(app, target, e)
-
-		{
-			stmt := "INSERT INTO " + target + "_embeddings (embedding) "
-			stmt += "VALUES ({:embedding});"
-			res, err := app.DB().NewQuery(stmt).Bind(dbx.Params{
-				"embedding": vector,
-			}).Execute()
-			if err != nil {
-				return nil
-			}
-			vectorId, err := res.LastInsertId()
+	for _, target := range collections {
+		collection, _ := app.Dao().FindCollectionByNameOrId(target.Name)
+		if collection == nil {
+			err := createCollection(app, target)
 			if err != nil {
+				app.Logger().Error(fmt.Sprint(err))
 				return err
 			}
-			record.Set("vector_id", vectorId)
 		}
-
-		if err := app.Dao().WithoutHooks().SaveRecord(record); err != nil {
+		if err := createChunksTable(app, target); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		if err := createEmbeddingsTable(app, target); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
+			return err
+		}
+		if err := createHashesTable(app, target.Name); err != nil {
+			app.Logger().Error(fmt.Sprint(err))
 			return err
 		}
 	}
 	return nil
 }
 
-func deleteEmbeddingsForRecord(app *pocketbase.PocketBase, target string, e *core.ModelEvent) error {
-	record, err := e.Dao.FindRecordById(e.Model.TableName(), e.Model.GetId())
-	if err != nil {
+func deleteCollection(app *pocketbase.PocketBase, target string) error {
+	if _, err := app.Dao().DB().
+		NewQuery("DELETE FROM " + target + "_embeddings;").
+		Execute(); err != nil {
 		return err
 	}
-
-	type Meta struct {
-		Id string `db:"id" json:"id"`
+	if _, err := app.Dao().DB().
+		NewQuery("DROP TABLE IF EXISTS " + target + "_embeddings;").
+		Execute(); err != nil {
+		return err
 	}
-	vectorId := record.GetInt("vector_id")
-	items := []*Meta{}
-	stmt := "SELECT id FROM " + target + "_embeddings "
-	stmt += "WHERE id = {:id};"
-	err = app.DB().NewQuery(stmt).Bind(dbx.Params{
-		"id": vectorId,
-	}).All(&items)
-	if err != nil {
-		return nil
+	if _, err := app.Dao().DB().
+		NewQuery("DROP TABLE IF EXISTS " + target + "_chunks;").
+		Execute(); err != nil {
+		return err
+	}
+	if _, err := app.Dao().DB().
+		NewQuery("DROP TABLE IF EXISTS " + target + "_hashes;").
+		Execute(); err != nil {
+		return err
+	}
+	if _, err := app.Dao().DB().
+		NewQuery("DELETE FROM _vector_jobs WHERE collection = {:collection};").
+		Bind(dbx.Params{"collection": target}).
+		Execute(); err != nil {
+		return err
+	}
+	if _, err := app.Dao().DB().
+		NewQuery("DELETE FROM _vector_reindex WHERE collection = {:collection};").
+		Bind(dbx.Params{"collection": target}).
+		Execute(); err != nil {
+		return err
 	}
+	return nil
+}
 
-	stmt = "DELETE FROM " + target + "_embeddings "
-	stmt += "WHERE id = {:id}"
+// embeddingText puts the title of a query on its own line before it.
+func embeddingText(title string, content string) string {
+	if title == "" {
+		return content
+	}
+	return title + "\n\n" + content
+}
 
-	for _, item := range items {
-		_, err = app.DB().NewQuery(stmt).Bind(dbx.Params{
-			"id": item.Id,
-		}).Execute()
-		if err != nil {
-			return nil
+func findVectorCollection(name string, collections ...VectorCollection) (VectorCollection, bool) {
+	for _, target := range collections {
+		if target.Name == name {
+			return target, true
 		}
 	}
-
-	return nil
+	return VectorCollection{}, false
 }
 
-func createCollection(app *pocketbase.PocketBase, target string, extraFields ...*schema.SchemaField) error {
-	fields := []*schema.SchemaField{
-		{
-			Name: "title",
-			Type: schema.FieldTypeText,
-		},
-		{
-			Name:     "content",
-			Required: true,
-			Type:     schema.FieldTypeText,
-		},
-		{
-			Name: "vector_id",
-			Type: schema.FieldTypeNumber,
-		},
+func createCollection(app *pocketbase.PocketBase, config VectorCollection) error {
+	target := config.Name
+	extraFields := config.ExtraFields
+	fields := []*schema.SchemaField{}
+	indexes := types.JsonArray[string]{}
+	if config.Template == "" && len(config.Fields) == 0 {
+		fields = append(fields,
+			&schema.SchemaField{
+				Name: "title",
+				Type: schema.FieldTypeText,
+			},
+			&schema.SchemaField{
+				Name:     "content",
+				Required: true,
+				Type:     schema.FieldTypeText,
+			},
+		)
+		indexes = append(indexes, "CREATE INDEX idx_"+target+" ON "+target+" (title, content);")
+	} else if config.Template == "" {
+		for _, name := range config.Fields {
+			fields = append(fields, &schema.SchemaField{
+				Name: name,
+				Type: schema.FieldTypeText,
+			})
+		}
 	}
 	for i, field := range extraFields {
 		options := field.Options
@@ -317,26 +423,34 @@ func createCollection(app *pocketbase.PocketBase, target string, extraFields ...
 	}
 	fields = append(fields, extraFields...)
 	collection := &models.Collection{
-		Name:   target,
-		Type:   models.CollectionTypeBase,
-		Schema: schema.NewSchema(fields...),
-		Indexes: types.JsonArray[string]{
-			"CREATE INDEX idx_" + target + " ON " + target + " (title, content);",
-		},
+		Name:    target,
+		Type:    models.CollectionTypeBase,
+		Schema:  schema.NewSchema(fields...),
+		Indexes: indexes,
 	}
 
 	if err := app.Dao().SaveCollection(collection); err != nil {
 		return err
 	}
 
-	stmt := "CREATE VIRTUAL TABLE IF NOT EXISTS " + target + "_embeddings using vec0( "
-	stmt += "	id INTEGER PRIMARY KEY AUTOINCREMENT, "
-	stmt += "	embedding float[768] "
-	stmt += ");"
-	_, err := app.DB().NewQuery(stmt).Execute()
-	if err != nil {
-		return nil
-	}
+	return nil
+}
 
+// configureDimensions fills the Model and Dimensions of the collection from
+// its embedder, and rejects the ones that disagree with it.
+func configureDimensions(config *VectorCollection) error {
+	if config.Model == "" {
+		config.Model = config.Embedder.ModelID()
+	} else if config.Model != config.Embedder.ModelID() {
+		return fmt.Errorf("%s is configured for %s but its embedder uses %s", config.Name, config.Model, config.Embedder.ModelID())
+	}
+	if config.Dimensions == 0 {
+		config.Dimensions = config.Embedder.Dimensions()
+	} else if config.Dimensions != config.Embedder.Dimensions() {
+		return fmt.Errorf("%s is configured for %d dimensions but its embedder returns %d", config.Name, config.Dimensions, config.Embedder.Dimensions())
+	}
+	if config.Dimensions <= 0 {
+		return fmt.Errorf("%s has no vector dimensions", config.Name)
+	}
 	return nil
 }
@@ -0,0 +1,266 @@
+package vector_search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/migrations/logs"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tokens"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// testEmbedder embeds a text as the sums of its runes, and records the
+// texts it was called with.
+type testEmbedder struct {
+	mu    sync.Mutex
+	texts []string
+	err   error
+}
+
+func (e *testEmbedder) Embed(ctx context.Context, texts []string, taskType TaskType) ([][]float32, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.texts = append(e.texts, texts...)
+	if e.err != nil {
+		return nil, e.err
+	}
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float32, 3)
+		for j, r := range text {
+			vectors[i][j%3] += float32(r)
+		}
+	}
+	return vectors, nil
+}
+
+func (e *testEmbedder) Dimensions() int {
+	return 3
+}
+
+func (e *testEmbedder) ModelID() string {
+	return "test"
+}
+
+// embedded returns the texts embedded since the last call.
+func (e *testEmbedder) embedded() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	texts := e.texts
+	e.texts = nil
+	return texts
+}
+
+// newTestApp bootstraps an app with the system migrations and the plugin
+// in a temporary directory. The configs are filled in by Init.
+func newTestApp(t *testing.T, configs []VectorCollection) *pocketbase.PocketBase {
+	t.Helper()
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir(), HideStartBanner: true})
+	if err := Init(app, configs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+	for db, list := range map[*dbx.DB]migrate.MigrationsList{
+		app.DB():     migrations.AppMigrations,
+		app.LogsDB(): logs.LogsMigrations,
+	} {
+		runner, err := migrate.NewRunner(db, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runner.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app
+}
+
+// serve runs the OnBeforeServe hooks like the serve command, which starts
+// the queue, and returns the router with the routes of the plugin.
+func serve(t *testing.T, app *pocketbase.PocketBase) *echo.Echo {
+	t.Helper()
+	router, err := apis.InitApi(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.OnBeforeServe().Trigger(&core.ServeEvent{App: app, Router: router}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.OnTerminate().Trigger(&core.TerminateEvent{App: app}) })
+	return router
+}
+
+// newNotesCollection creates a notes collection listed by everyone.
+func newNotesCollection(t *testing.T, app *pocketbase.PocketBase) *models.Collection {
+	t.Helper()
+	notes := &models.Collection{
+		Name:     "notes",
+		Type:     models.CollectionTypeBase,
+		ListRule: types.Pointer(""),
+		Schema: schema.NewSchema(
+			&schema.SchemaField{Name: "title", Type: schema.FieldTypeText},
+			&schema.SchemaField{Name: "content", Type: schema.FieldTypeText},
+		),
+	}
+	if err := app.Dao().SaveCollection(notes); err != nil {
+		t.Fatal(err)
+	}
+	return notes
+}
+
+func saveRecord(t *testing.T, app *pocketbase.PocketBase, collection *models.Collection, values map[string]any) *models.Record {
+	t.Helper()
+	record := models.NewRecord(collection)
+	record.Load(values)
+	if collection.IsAuth() {
+		record.RefreshId()
+		record.RefreshTokenKey()
+		record.SetUsername("u" + record.Id)
+		record.SetPassword("1234567890")
+	}
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func adminToken(t *testing.T, app *pocketbase.PocketBase) string {
+	t.Helper()
+	admin := &models.Admin{Email: "admin@example.com"}
+	admin.SetPassword("1234567890")
+	if err := app.Dao().SaveAdmin(admin); err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.NewAdminAuthToken(app, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func userToken(t *testing.T, app *pocketbase.PocketBase) string {
+	t.Helper()
+	users, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.NewRecordAuthToken(app, saveRecord(t, app, users, map[string]any{"email": "user@example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// request sends a request to the router and returns the status and the
+// JSON body.
+func request(router *echo.Echo, method string, url string, token string, body string) (int, any) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var data any
+	json.Unmarshal(rec.Body.Bytes(), &data)
+	return rec.Code, data
+}
+
+// waitFor polls until done returns true, for the work of the queue and of
+// the background reindexes.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	embedder := &testEmbedder{}
+	configs := []VectorCollection{{Name: "docs", Embedder: embedder}, {Name: "notes", Embedder: embedder}}
+	app := newTestApp(t, configs)
+	notes := newNotesCollection(t, app)
+	router := serve(t, app)
+
+	docs, err := app.Dao().FindCollectionByNameOrId("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveRecord(t, app, docs, map[string]any{"title": "private", "content": "hidden text"})
+	saveRecord(t, app, notes, map[string]any{"title": "public", "content": "shared text"})
+	user := userToken(t, app)
+	admin := adminToken(t, app)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		body   string
+		status int
+	}{
+		{"guest blocked by the list rule", "GET", "/api/collections/docs/records/vector-search?search=text", "", "", 403},
+		{"user blocked by the list rule", "GET", "/api/collections/docs/records/vector-search?search=text", user, "", 403},
+		{"admin search", "GET", "/api/collections/docs/records/vector-search?search=text", admin, "", 200},
+		{"guest search", "GET", "/api/collections/notes/records/vector-search?search=text", "", "", 200},
+		{"guest vector blocked by the list rule", "POST", "/api/collections/docs/records/vector-search", "", `{"vector":[1,2,3]}`, 403},
+		{"guest vector", "POST", "/api/collections/notes/records/vector-search", "", `{"vector":[1,2,3]}`, 200},
+		{"vector with other dimensions", "POST", "/api/collections/notes/records/vector-search", "", `{"vector":[1,2]}`, 400},
+		{"k that isn't a number", "GET", "/api/collections/notes/records/vector-search?search=text&k=ten", "", "", 400},
+		{"zero k", "GET", "/api/collections/notes/records/vector-search?search=text&k=0", "", "", 400},
+		{"too large k", "POST", "/api/collections/notes/records/vector-search", "", `{"vector":[1,2,3],"k":5000}`, 400},
+		{"collection without vectors", "GET", "/api/collections/users/records/vector-search?search=text", admin, "", 404},
+		{"guest reindex", "POST", "/api/collections/notes/records/vector-search/reindex", "", "", 401},
+		{"user reindex", "POST", "/api/collections/notes/records/vector-search/reindex", user, "", 401},
+		{"guest reindex progress", "GET", "/api/collections/notes/records/vector-search/reindex", "", "", 401},
+		{"admin reindex progress before any reindex", "GET", "/api/collections/notes/records/vector-search/reindex", admin, "", 404},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := request(router, test.method, test.url, test.token, test.body); status != test.status {
+				t.Errorf("got status %d, want %d: %v", status, test.status, body)
+			}
+		})
+	}
+
+	t.Run("admin reindex", func(t *testing.T) {
+		status, body := request(router, "POST", "/api/collections/notes/records/vector-search/reindex?batchSize=1", admin, "")
+		if status != 202 {
+			t.Fatalf("got status %d: %v", status, body)
+		}
+		waitFor(t, "the reindex", func() bool {
+			_, body := request(router, "GET", "/api/collections/notes/records/vector-search/reindex", admin, "")
+			progress, _ := body.(map[string]any)
+			return progress["status"] == ReindexDone
+		})
+	})
+
+	t.Run("guest search results", func(t *testing.T) {
+		waitFor(t, "the queue", func() bool {
+			_, body := request(router, "GET", "/api/collections/notes/records/vector-search?search=shared+text", "", "")
+			items, _ := body.([]any)
+			return len(items) == 1
+		})
+	})
+}
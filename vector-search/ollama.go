@@ -0,0 +1,67 @@
+package vector_search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OllamaEmbedder embeds texts with a local Ollama server. Models that expect
+// task prefixes, like nomic-embed-text, can set DocumentPrefix and
+// QueryPrefix.
+type OllamaEmbedder struct {
+	// BaseURL defaults to "http://localhost:11434".
+	BaseURL string
+	Model   string
+	Dims    int
+	// DocumentPrefix and QueryPrefix are prepended to the texts of each
+	// task type, eg. "search_document: " and "search_query: ".
+	DocumentPrefix string
+	QueryPrefix    string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (o *OllamaEmbedder) Embed(ctx context.Context, texts []string, taskType TaskType) ([][]float32, error) {
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = "http://localhost:11434"
+	}
+	prefix := o.taskPrefix(taskType)
+	input := make([]string, len(texts))
+	for i, text := range texts {
+		input[i] = prefix + text
+	}
+
+	res := struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}{}
+	body := map[string]any{
+		"model": o.Model,
+		"input": input,
+	}
+	if err := postJson(ctx, o.HTTPClient, strings.TrimSuffix(baseURL, "/")+"/api/embed", nil, body, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d texts", o.Model, len(res.Embeddings), len(texts))
+	}
+	return res.Embeddings, nil
+}
+
+// taskPrefix is the prefix prepended to the texts of a task type.
+func (o *OllamaEmbedder) taskPrefix(taskType TaskType) string {
+	if taskType == TaskTypeQuery {
+		return o.QueryPrefix
+	}
+	return o.DocumentPrefix
+}
+
+func (o *OllamaEmbedder) Dimensions() int {
+	return o.Dims
+}
+
+func (o *OllamaEmbedder) ModelID() string {
+	return o.Model
+}
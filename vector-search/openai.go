@@ -0,0 +1,105 @@
+package vector_search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OpenAiEmbedder embeds texts with any API that implements the OpenAI
+// embeddings endpoint, eg. OpenAI, Azure, vLLM, LM Studio or llama.cpp.
+// The task type is ignored.
+type OpenAiEmbedder struct {
+	// BaseURL defaults to "https://api.openai.com/v1".
+	BaseURL string
+	APIKey  string
+	Model   string
+	Dims    int
+	// SendDimensions adds the dimensions param to the requests, for models
+	// that can shorten their vectors.
+	SendDimensions bool
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (o *OpenAiEmbedder) Embed(ctx context.Context, texts []string, taskType TaskType) ([][]float32, error) {
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	body := map[string]any{
+		"model": o.Model,
+		"input": texts,
+	}
+	if o.SendDimensions {
+		body["dimensions"] = o.Dims
+	}
+	header := http.Header{}
+	if o.APIKey != "" {
+		header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	res := struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}{}
+	if err := postJson(ctx, o.HTTPClient, strings.TrimSuffix(baseURL, "/")+"/embeddings", header, body, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Data) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d texts", o.Model, len(res.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, item := range res.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("%s returned an embedding for unknown index %d", o.Model, item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	return vectors, nil
+}
+
+func (o *OpenAiEmbedder) Dimensions() int {
+	return o.Dims
+}
+
+func (o *OpenAiEmbedder) ModelID() string {
+	return o.Model
+}
+
+// postJson posts body as JSON and decodes the JSON response into out.
+func postJson(ctx context.Context, client *http.Client, url string, header http.Header, body any, out any) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		message := struct {
+			Error any `json:"error"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&message)
+		return fmt.Errorf("POST %s: %s %v", url, res.Status, message.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,113 @@
+package vector_search
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Quantized collections search int8 or binary vectors in their vec0 table,
+// which are 4 or 32 times smaller than float32 ones. The full vectors are
+// kept in the <name>_chunks table, to rescore the nearest candidates.
+
+const (
+	// QuantizeInt8 scales every value from [-1, 1] to an int8.
+	QuantizeInt8 = "int8"
+	// QuantizeBit keeps the sign of every value, and compares vectors by
+	// their hamming distance.
+	QuantizeBit = "bit"
+)
+
+// DefaultRescore is the number of quantized candidates rescored per result.
+var DefaultRescore = 8
+
+// configureQuantization checks the Quantization of the collection.
+func configureQuantization(config *VectorCollection) error {
+	switch config.Quantization {
+	case "", QuantizeInt8:
+	case QuantizeBit:
+		if config.Dimensions%8 != 0 {
+			return fmt.Errorf("%s can't be quantized to bits, its %d dimensions aren't a multiple of 8", config.Name, config.Dimensions)
+		}
+	default:
+		return fmt.Errorf("%s has an unknown quantization %q, use int8 or bit", config.Name, config.Quantization)
+	}
+	if config.Rescore <= 0 {
+		config.Rescore = DefaultRescore
+	}
+	return nil
+}
+
+// vectorColumn is the definition of the searched column of the vec0 table.
+func vectorColumn(config VectorCollection) string {
+	size := "[" + fmt.Sprint(config.Dimensions) + "]"
+	switch config.Quantization {
+	case QuantizeInt8:
+		return "embedding int8" + size + distanceOption(config.DistanceMetric)
+	case QuantizeBit:
+		return "embedding bit" + size
+	}
+	return "embedding float" + size + distanceOption(config.DistanceMetric)
+}
+
+// quantizeExpr quantizes the float32 vector of a SQL expression, eg. a JSON
+// array or a blob, for the vec0 table of the collection.
+func quantizeExpr(quantization string, expr string) string {
+	switch quantization {
+	case QuantizeInt8:
+		return "vec_quantize_int8(vec_f32(" + expr + "), 'unit')"
+	case QuantizeBit:
+		return "vec_quantize_binary(vec_f32(" + expr + "))"
+	}
+	return expr
+}
+
+// rescore replaces the distance of the candidates with the distance of their
+// full vectors, and sorts them again. Candidates without a full vector are
+// dropped, since their quantized distance isn't comparable.
+func rescore(config VectorCollection, vector []float32, candidates []*chunkMatch) []*chunkMatch {
+	candidates = slices.DeleteFunc(candidates, func(candidate *chunkMatch) bool {
+		return candidate.Vector == nil
+	})
+	for _, candidate := range candidates {
+		candidate.Distance = vectorDistance(config.DistanceMetric, vector, decodeVector(candidate.Vector))
+	}
+	slices.SortStableFunc(candidates, func(a, b *chunkMatch) int {
+		switch {
+		case a.Distance < b.Distance:
+			return -1
+		case a.Distance > b.Distance:
+			return 1
+		}
+		return 0
+	})
+	return candidates
+}
+
+// vectorDistance is the distance between two vectors, as computed by vec0.
+func vectorDistance(metric string, a []float32, b []float32) float64 {
+	sum, normA, normB := 0.0, 0.0, 0.0
+	for i := range min(len(a), len(b)) {
+		x, y := float64(a[i]), float64(b[i])
+		switch metric {
+		case DistanceL1:
+			sum += math.Abs(x - y)
+		case DistanceCosine:
+			sum += x * y
+			normA += x * x
+			normB += y * y
+		default:
+			sum += (x - y) * (x - y)
+		}
+	}
+	switch metric {
+	case DistanceL1:
+		return sum
+	case DistanceCosine:
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return 1 - sum/math.Sqrt(normA*normB)
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,286 @@
+package vector_search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+)
+
+// Records are embedded in the background. Saving a record only upserts its
+// row in the _vector_jobs table, which a pool of workers processes with
+// exponential backoff. Jobs that keep failing are marked dead, and running
+// jobs are retried after a restart.
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDead    = "dead"
+)
+
+var (
+	// QueueWorkers is the number of records embedded at the same time.
+	QueueWorkers = 4
+	// QueueMaxAttempts is how many times a job runs before it is dead.
+	QueueMaxAttempts = 8
+	// QueueBackoff is the delay before the first retry, doubled for every
+	// later one up to QueueMaxBackoff.
+	QueueBackoff    = 5 * time.Second
+	QueueMaxBackoff = 30 * time.Minute
+	// QueuePollInterval is the longest time a worker sleeps between checks
+	// for due jobs, eg. the ones saved in other transactions.
+	QueuePollInterval = 10 * time.Second
+)
+
+type vectorJob struct {
+	Id         int64  `db:"id"`
+	Collection string `db:"collection"`
+	Record     string `db:"record"`
+	Attempts   int    `db:"attempts"`
+	Version    int    `db:"version"`
+}
+
+type queue struct {
+	app         *pocketbase.PocketBase
+	collections []VectorCollection
+	wake        chan struct{}
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+func newQueue(app *pocketbase.PocketBase, collections []VectorCollection) *queue {
+	return &queue{
+		app:         app,
+		collections: collections,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func createJobsTable(app *pocketbase.PocketBase) error {
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS _vector_jobs (" +
+			"  id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"  collection TEXT NOT NULL," +
+			"  record TEXT NOT NULL," +
+			"  status TEXT NOT NULL DEFAULT 'pending'," +
+			"  attempts INTEGER NOT NULL DEFAULT 0," +
+			"  version INTEGER NOT NULL DEFAULT 0," +
+			"  next_run INTEGER NOT NULL DEFAULT 0," +
+			"  error TEXT NOT NULL DEFAULT ''," +
+			"  UNIQUE (collection, record)" +
+			");",
+		"CREATE INDEX IF NOT EXISTS idx_vector_jobs_next_run ON _vector_jobs (status, next_run);",
+	}
+	for _, stmt := range stmts {
+		app.Logger().Info(stmt)
+		if _, err := app.DB().NewQuery(stmt).Execute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetJobs reschedules the jobs that were running when the server stopped.
+func resetJobs(app *pocketbase.PocketBase) error {
+	_, err := app.DB().
+		NewQuery("UPDATE _vector_jobs SET status = 'pending' WHERE status = 'running';").
+		Execute()
+	return err
+}
+
+// enqueue schedules a record to be embedded. A record that is being embedded
+// gets a new version, so that it runs again once the worker is done.
+func enqueue(db dbx.Builder, target string, recordId string) error {
+	_, err := db.NewQuery(
+		"INSERT INTO _vector_jobs (collection, record, next_run) VALUES ({:collection}, {:record}, {:now}) " +
+			"ON CONFLICT (collection, record) DO UPDATE SET " +
+			"  version = version + 1," +
+			"  status = CASE WHEN status = 'running' THEN 'running' ELSE 'pending' END," +
+			"  attempts = 0," +
+			"  next_run = {:now}," +
+			"  error = '';",
+	).Bind(dbx.Params{
+		"collection": target,
+		"record":     recordId,
+		"now":        time.Now().UnixMilli(),
+	}).Execute()
+	return err
+}
+
+// dequeue drops the job of a deleted record.
+func dequeue(db dbx.Builder, target string, recordId string) error {
+	_, err := db.
+		NewQuery("DELETE FROM _vector_jobs WHERE collection = {:collection} AND record = {:record};").
+		Bind(dbx.Params{"collection": target, "record": recordId}).
+		Execute()
+	return err
+}
+
+func (q *queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for i := 0; i < QueueWorkers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work(ctx)
+		}()
+	}
+}
+
+// stop cancels the running jobs, which are retried on the next start.
+func (q *queue) stop() {
+	if q.cancel == nil {
+		return
+	}
+	q.cancel()
+	q.wg.Wait()
+}
+
+func (q *queue) work(ctx context.Context) {
+	for {
+		job, err := q.claim()
+		if err != nil {
+			q.app.Logger().Error(fmt.Sprint(err))
+		}
+		if job != nil {
+			err := q.run(ctx, job)
+			if ctx.Err() != nil {
+				// Left running, to be retried after the restart.
+				return
+			}
+			q.finish(job, err)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.idle()):
+		}
+	}
+}
+
+// idle is how long a worker can sleep until the next pending job is due.
+func (q *queue) idle() time.Duration {
+	var next sql.NullInt64
+	err := q.app.DB().
+		NewQuery("SELECT MIN(next_run) FROM _vector_jobs WHERE status = 'pending';").
+		Row(&next)
+	if err != nil || !next.Valid {
+		return QueuePollInterval
+	}
+	delay := time.Until(time.UnixMilli(next.Int64))
+	return min(max(delay, 10*time.Millisecond), QueuePollInterval)
+}
+
+// claim marks the next due job as running.
+func (q *queue) claim() (*vectorJob, error) {
+	var job *vectorJob
+	err := q.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		found := &vectorJob{}
+		err := txDao.DB().
+			NewQuery("SELECT id, collection, record, attempts, version FROM _vector_jobs WHERE status = 'pending' AND next_run <= {:now} ORDER BY next_run LIMIT 1;").
+			Bind(dbx.Params{"now": time.Now().UnixMilli()}).
+			One(found)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = txDao.DB().
+			NewQuery("UPDATE _vector_jobs SET status = 'running', attempts = attempts + 1 WHERE id = {:id};").
+			Bind(dbx.Params{"id": found.Id}).
+			Execute()
+		if err != nil {
+			return err
+		}
+		found.Attempts++
+		job = found
+		return nil
+	})
+	return job, err
+}
+
+func (q *queue) run(ctx context.Context, job *vectorJob) error {
+	config, ok := findVectorCollection(job.Collection, q.collections...)
+	if !ok {
+		return fmt.Errorf("%s is not a vector collection", job.Collection)
+	}
+	record, err := q.app.Dao().FindRecordById(job.Collection, job.Record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return deleteChunks(q.app.DB(), job.Collection, job.Record)
+	}
+	if err != nil {
+		return err
+	}
+	text, err := sourceText(config, record)
+	if err != nil {
+		return err
+	}
+	hash := contentHash(config, text)
+	stored, err := storedHash(q.app.DB(), config.Name, record.Id)
+	if err != nil {
+		return err
+	}
+	if stored == hash {
+		return updateMetadata(q.app.DB(), config, record)
+	}
+	return saveChunks(ctx, q.app, config, record, hash, chunkText(text, config.Chunking))
+}
+
+// finish deletes a job that succeeded, unless its record changed meanwhile,
+// and schedules a retry or marks it dead when it failed.
+func (q *queue) finish(job *vectorJob, jobErr error) {
+	params := dbx.Params{
+		"id":      job.Id,
+		"version": job.Version,
+		"now":     time.Now().UnixMilli(),
+	}
+	stmts := []string{
+		"DELETE FROM _vector_jobs WHERE id = {:id} AND version = {:version};",
+		"UPDATE _vector_jobs SET status = 'pending', attempts = 0, next_run = {:now} WHERE id = {:id};",
+	}
+	if jobErr != nil {
+		q.app.Logger().Error(fmt.Sprintf("embedding %s/%s failed: %v", job.Collection, job.Record, jobErr))
+		params["error"] = jobErr.Error()
+		params["status"] = JobPending
+		if job.Attempts >= QueueMaxAttempts {
+			params["status"] = JobDead
+		}
+		params["next_run"] = time.Now().Add(backoff(job.Attempts)).UnixMilli()
+		stmts = []string{
+			"UPDATE _vector_jobs SET status = {:status}, next_run = {:next_run}, error = {:error} WHERE id = {:id};",
+		}
+	}
+	for _, stmt := range stmts {
+		if _, err := q.app.DB().NewQuery(stmt).Bind(params).Execute(); err != nil {
+			q.app.Logger().Error(fmt.Sprint(err))
+			return
+		}
+	}
+	q.notify()
+}
+
+// backoff is the delay before the next attempt of a job.
+func backoff(attempts int) time.Duration {
+	delay := QueueBackoff
+	for i := 1; i < attempts && delay < QueueMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, QueueMaxBackoff)
+}
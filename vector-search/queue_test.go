@@ -0,0 +1,95 @@
+package vector_search
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+)
+
+type testJob struct {
+	Status   string `db:"status"`
+	Attempts int    `db:"attempts"`
+	Error    string `db:"error"`
+}
+
+// findJob returns the job of a record, or nil once it is done.
+func findJob(app *pocketbase.PocketBase, recordId string) *testJob {
+	jobs := []*testJob{}
+	app.DB().
+		NewQuery("SELECT status, attempts, error FROM _vector_jobs WHERE record = {:record};").
+		Bind(dbx.Params{"record": recordId}).
+		All(&jobs)
+	if len(jobs) == 0 {
+		return nil
+	}
+	return jobs[0]
+}
+
+func TestQueue(t *testing.T) {
+	embedder := &testEmbedder{}
+	app := newTestApp(t, []VectorCollection{{Name: "docs", Embedder: embedder}})
+	serve(t, app)
+	docs, err := app.Dao().FindCollectionByNameOrId("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := saveRecord(t, app, docs, map[string]any{"title": "one", "content": "first text"})
+	waitFor(t, "the job of the new record", func() bool { return findJob(app, record.Id) == nil })
+	if texts := embedder.embedded(); !slices.Equal(texts, []string{"one\n\nfirst text"}) {
+		t.Errorf("embedded %q", texts)
+	}
+	hash, err := storedHash(app.DB(), "docs", record.Id)
+	if err != nil || hash == "" {
+		t.Fatalf("no hash was stored: %v", err)
+	}
+
+	// A record whose text didn't change isn't embedded again.
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the job of the updated record", func() bool { return findJob(app, record.Id) == nil })
+	if texts := embedder.embedded(); len(texts) != 0 {
+		t.Errorf("embedded %q again", texts)
+	}
+
+	maxAttempts := QueueMaxAttempts
+	QueueMaxAttempts = 1
+	t.Cleanup(func() { QueueMaxAttempts = maxAttempts })
+	embedder.mu.Lock()
+	embedder.err = errors.New("embedder down")
+	embedder.mu.Unlock()
+	failed := saveRecord(t, app, docs, map[string]any{"title": "two", "content": "second text"})
+	waitFor(t, "the failed job", func() bool {
+		job := findJob(app, failed.Id)
+		return job != nil && job.Status == JobDead
+	})
+	if job := findJob(app, failed.Id); job.Attempts != 1 || job.Error != "embedder down" {
+		t.Errorf("got the dead job %+v", job)
+	}
+
+	if err := app.Dao().DeleteRecord(failed); err != nil {
+		t.Fatal(err)
+	}
+	if job := findJob(app, failed.Id); job != nil {
+		t.Errorf("the job of the deleted record is still %+v", job)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  QueueBackoff,
+		2:  2 * QueueBackoff,
+		3:  4 * QueueBackoff,
+		20: QueueMaxBackoff,
+	}
+	for attempts, want := range tests {
+		if delay := backoff(attempts); delay != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, delay, want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package vector_search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/spf13/cobra"
+)
+
+// A reindex embeds the records of a collection in id order, BatchSize
+// records per batch. Its progress is saved in the _vector_reindex table
+// after every batch, so an interrupted reindex continues where it stopped
+// the next time it runs.
+
+// DefaultReindexBatchSize is the number of records embedded per batch.
+var DefaultReindexBatchSize = 50
+
+type ReindexOptions struct {
+	// MissingOnly skips the records that already have embeddings.
+	MissingOnly bool
+	BatchSize   int
+	// Progress is called after every batch.
+	Progress func(status *ReindexStatus)
+}
+
+type ReindexStatus struct {
+	Collection  string `db:"collection" json:"collection"`
+	Status      string `db:"status" json:"status"`
+	MissingOnly bool   `db:"missing_only" json:"missingOnly"`
+	Cursor      string `db:"cursor" json:"-"`
+	Done        int    `db:"done" json:"done"`
+	Total       int    `db:"total" json:"total"`
+	Error       string `db:"error" json:"error,omitempty"`
+	Updated     int64  `db:"updated" json:"updated"`
+}
+
+const (
+	ReindexRunning = "running"
+	ReindexDone    = "done"
+	ReindexFailed  = "failed"
+	// ReindexStopped is a reindex that was cancelled, eg. when the server
+	// stopped. It continues where it stopped the next time it runs.
+	ReindexStopped = "stopped"
+)
+
+// reindexing guards against running two reindexes of a collection in the
+// same process.
+var reindexing = struct {
+	sync.Mutex
+	collections map[string]bool
+}{collections: map[string]bool{}}
+
+func createReindexTable(app *pocketbase.PocketBase) error {
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS _vector_reindex (" +
+			"  collection TEXT PRIMARY KEY," +
+			"  status TEXT NOT NULL," +
+			"  missing_only BOOLEAN NOT NULL DEFAULT FALSE," +
+			"  cursor TEXT NOT NULL DEFAULT ''," +
+			"  done INTEGER NOT NULL DEFAULT 0," +
+			"  total INTEGER NOT NULL DEFAULT 0," +
+			"  error TEXT NOT NULL DEFAULT ''," +
+			"  updated INTEGER NOT NULL DEFAULT 0" +
+			");",
+		// Reindexes that were running when the process exited.
+		"UPDATE _vector_reindex SET status = 'stopped' WHERE status = 'running';",
+	}
+	for _, stmt := range stmts {
+		app.Logger().Info(stmt)
+		if _, err := app.DB().NewQuery(stmt).Execute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexStatus reads the progress of the last reindex of a collection, or
+// nil when it was never reindexed.
+func reindexStatus(app *pocketbase.PocketBase, target string) (*ReindexStatus, error) {
+	status := &ReindexStatus{}
+	err := app.DB().
+		NewQuery("SELECT * FROM _vector_reindex WHERE collection = {:collection};").
+		Bind(dbx.Params{"collection": target}).
+		One(status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return status, err
+}
+
+func saveReindexStatus(app *pocketbase.PocketBase, status *ReindexStatus) error {
+	status.Updated = time.Now().UnixMilli()
+	_, err := app.DB().NewQuery(
+		"INSERT OR REPLACE INTO _vector_reindex (collection, status, missing_only, cursor, done, total, error, updated) " +
+			"VALUES ({:collection}, {:status}, {:missing_only}, {:cursor}, {:done}, {:total}, {:error}, {:updated});",
+	).Bind(dbx.Params{
+		"collection":   status.Collection,
+		"status":       status.Status,
+		"missing_only": status.MissingOnly,
+		"cursor":       status.Cursor,
+		"done":         status.Done,
+		"total":        status.Total,
+		"error":        status.Error,
+		"updated":      status.Updated,
+	}).Execute()
+	return err
+}
+
+// Reindex embeds the records of a collection with the batch API of its
+// embedder, continuing the previous reindex if it didn't finish.
+func Reindex(ctx context.Context, app *pocketbase.PocketBase, config VectorCollection, options ReindexOptions) (*ReindexStatus, error) {
+	target := config.Name
+	reindexing.Lock()
+	if reindexing.collections[target] {
+		reindexing.Unlock()
+		return nil, fmt.Errorf("%s is already being reindexed", target)
+	}
+	reindexing.collections[target] = true
+	reindexing.Unlock()
+	defer func() {
+		reindexing.Lock()
+		delete(reindexing.collections, target)
+		reindexing.Unlock()
+	}()
+
+	collection, err := app.Dao().FindCollectionByNameOrId(target)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultReindexBatchSize
+	}
+
+	status, err := reindexStatus(app, target)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil || status.Status == ReindexDone || status.MissingOnly != options.MissingOnly {
+		status = &ReindexStatus{Collection: target, MissingOnly: options.MissingOnly}
+	}
+	remaining := 0
+	if err := reindexQuery(app, collection, status).Select("COUNT(*)").Row(&remaining); err != nil {
+		return nil, err
+	}
+	status.Status = ReindexRunning
+	status.Error = ""
+	status.Total = status.Done + remaining
+	if err := saveReindexStatus(app, status); err != nil {
+		return nil, err
+	}
+	if options.Progress != nil {
+		options.Progress(status)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			status.Status = ReindexStopped
+			saveReindexStatus(app, status)
+			return status, err
+		}
+		ids := []string{}
+		err := reindexQuery(app, collection, status).
+			Select("[[" + target + ".id]]").
+			OrderBy("[[" + target + ".id]] ASC").
+			Limit(int64(batchSize)).
+			Column(&ids)
+		if err == nil && len(ids) > 0 {
+			err = reindexBatch(ctx, app, config, collection, ids)
+		}
+		if err != nil {
+			status.Status = ReindexFailed
+			status.Error = err.Error()
+			if ctx.Err() != nil {
+				status.Status = ReindexStopped
+				status.Error = ""
+			}
+			saveReindexStatus(app, status)
+			return status, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		status.Cursor = ids[len(ids)-1]
+		status.Done += len(ids)
+		if err := saveReindexStatus(app, status); err != nil {
+			return status, err
+		}
+		if options.Progress != nil {
+			options.Progress(status)
+		}
+	}
+
+	status.Status = ReindexDone
+	status.Total = status.Done
+	if err := saveReindexStatus(app, status); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// reindexQuery selects the records after the cursor of the reindex.
+func reindexQuery(app *pocketbase.PocketBase, collection *models.Collection, status *ReindexStatus) *dbx.SelectQuery {
+	tbl := collection.Name
+	query := app.Dao().DB().
+		Select().
+		From(tbl).
+		Where(dbx.NewExp("[["+tbl+".id]] > {:cursor}", dbx.Params{"cursor": status.Cursor}))
+	if status.MissingOnly {
+		query.AndWhere(dbx.NewExp("[[" + tbl + ".id]] NOT IN (SELECT record FROM " + tbl + "_chunks)"))
+	}
+	return query
+}
+
+// reindexBatch embeds the chunks of all the changed records in one go, and
+// replaces their chunks and queued jobs.
+func reindexBatch(ctx context.Context, app *pocketbase.PocketBase, config VectorCollection, collection *models.Collection, ids []string) error {
+	records, err := app.Dao().FindRecordsByIds(collection.Id, ids)
+	if err != nil {
+		return err
+	}
+	chunks := map[string][]Chunk{}
+	hashes := map[string]string{}
+	texts := []string{}
+	for _, record := range records {
+		text, err := sourceText(config, record)
+		if err != nil {
+			return err
+		}
+		hashes[record.Id] = contentHash(config, text)
+		stored, err := storedHash(app.DB(), config.Name, record.Id)
+		if err != nil {
+			return err
+		}
+		if stored == hashes[record.Id] {
+			continue
+		}
+		chunks[record.Id] = chunkText(text, config.Chunking)
+		for _, chunk := range chunks[record.Id] {
+			texts = append(texts, chunk.Text)
+		}
+	}
+	vectors, err := embedBatches(ctx, app, config, texts, TaskTypeDocument)
+	if err != nil {
+		return err
+	}
+
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for _, record := range records {
+			if recordChunks, ok := chunks[record.Id]; ok {
+				if err := storeChunks(txDao.DB(), config, record.Id, hashes[record.Id], metadataValues(config, record), recordChunks, vectors[:len(recordChunks)]); err != nil {
+					return err
+				}
+				vectors = vectors[len(recordChunks):]
+			} else if err := updateMetadata(txDao.DB(), config, record); err != nil {
+				return err
+			}
+			_, err := txDao.DB().
+				NewQuery("DELETE FROM _vector_jobs WHERE collection = {:collection} AND record = {:record} AND status != 'running';").
+				Bind(dbx.Params{"collection": config.Name, "record": record.Id}).
+				Execute()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func reindexCommand(app *pocketbase.PocketBase, collections []VectorCollection) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "vectors",
+		Short: "Manages the vector search collections",
+	}
+
+	var missingOnly bool
+	var batchSize int
+	reindex := &cobra.Command{
+		Use:   "reindex [collection]",
+		Short: "Embeds the records of one or all vector collections",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := collections
+			if len(args) > 0 {
+				config, ok := findVectorCollection(args[0], collections...)
+				if !ok {
+					return fmt.Errorf("%s is not a vector collection", args[0])
+				}
+				targets = []VectorCollection{config}
+			}
+			if err := setupCollections(app, collections); err != nil {
+				return err
+			}
+			for _, config := range targets {
+				_, err := Reindex(cmd.Context(), app, config, ReindexOptions{
+					MissingOnly: missingOnly,
+					BatchSize:   batchSize,
+					Progress: func(status *ReindexStatus) {
+						fmt.Printf("%s: %d/%d records\n", status.Collection, status.Done, status.Total)
+					},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	reindex.Flags().BoolVar(&missingOnly, "missing-only", false, "only embed the records without embeddings")
+	reindex.Flags().IntVar(&batchSize, "batch-size", DefaultReindexBatchSize, "number of records embedded per batch")
+	command.AddCommand(reindex)
+	return command
+}
+
+// reindexHandlers start a reindex in the background, and report its
+// progress. Background reindexes are stopped when the app terminates.
+func reindexHandlers(app *pocketbase.PocketBase, collections []VectorCollection) (echo.HandlerFunc, echo.HandlerFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	app.OnTerminate().Add(func(e *core.TerminateEvent) error {
+		cancel()
+		background.Wait()
+		return nil
+	})
+
+	find := func(c echo.Context) (VectorCollection, error) {
+		collection, err := app.Dao().FindCollectionByNameOrId(c.PathParam("collectionIdOrName"))
+		if err != nil {
+			return VectorCollection{}, apis.NewNotFoundError("", err)
+		}
+		config, ok := findVectorCollection(collection.Name, collections...)
+		if !ok {
+			return VectorCollection{}, apis.NewNotFoundError("Vector search is not enabled for "+collection.Name+".", nil)
+		}
+		return config, nil
+	}
+
+	start := func(c echo.Context) error {
+		config, err := find(c)
+		if err != nil {
+			return err
+		}
+		missingOnly, _ := strconv.ParseBool(c.QueryParam("missingOnly"))
+		batchSize, _ := strconv.Atoi(c.QueryParam("batchSize"))
+
+		reindexing.Lock()
+		running := reindexing.collections[config.Name]
+		reindexing.Unlock()
+		if running {
+			return apis.NewBadRequestError(config.Name+" is already being reindexed.", nil)
+		}
+		// Respond once the status of the new reindex is saved.
+		started := make(chan struct{})
+		var once sync.Once
+		signal := func() { once.Do(func() { close(started) }) }
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			_, err := Reindex(ctx, app, config, ReindexOptions{
+				MissingOnly: missingOnly,
+				BatchSize:   batchSize,
+				Progress:    func(status *ReindexStatus) { signal() },
+			})
+			if err != nil && ctx.Err() == nil {
+				app.Logger().Error(fmt.Sprint(err))
+			}
+			signal()
+		}()
+		<-started
+
+		status, err := reindexStatus(app, config.Name)
+		if err != nil {
+			return err
+		}
+		return c.JSON(202, status)
+	}
+
+	progress := func(c echo.Context) error {
+		config, err := find(c)
+		if err != nil {
+			return err
+		}
+		status, err := reindexStatus(app, config.Name)
+		if err != nil {
+			return err
+		}
+		if status == nil {
+			return apis.NewNotFoundError(config.Name+" was never reindexed.", nil)
+		}
+		return c.JSON(200, status)
+	}
+
+	return start, progress
+}
@@ -0,0 +1,87 @@
+package vector_search
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	embedder := &testEmbedder{}
+	configs := []VectorCollection{{Name: "docs", Embedder: embedder}}
+	app := newTestApp(t, configs)
+	// Without serve the queue doesn't run, and only the reindex embeds.
+	if err := setupCollections(app, configs); err != nil {
+		t.Fatal(err)
+	}
+	config := configs[0]
+	docs, err := app.Dao().FindCollectionByNameOrId("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		saveRecord(t, app, docs, map[string]any{"content": content})
+	}
+
+	progress := []int{}
+	status, err := Reindex(context.Background(), app, config, ReindexOptions{
+		BatchSize: 2,
+		Progress:  func(status *ReindexStatus) { progress = append(progress, status.Done) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != ReindexDone || status.Done != 3 || status.Total != 3 {
+		t.Errorf("got %+v", status)
+	}
+	if len(progress) != 3 || progress[2] != 3 {
+		t.Errorf("got the progress %v, want one call per batch", progress)
+	}
+	if texts := embedder.embedded(); len(texts) != 3 {
+		t.Errorf("embedded %q, want the 3 records", texts)
+	}
+
+	// The hashes didn't change, so nothing is embedded again.
+	if _, err := Reindex(context.Background(), app, config, ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if texts := embedder.embedded(); len(texts) != 0 {
+		t.Errorf("embedded %q again", texts)
+	}
+
+	saveRecord(t, app, docs, map[string]any{"content": "four"})
+	status, err = Reindex(context.Background(), app, config, ReindexOptions{MissingOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Done != 1 {
+		t.Errorf("reindexed %d records, want the one without embeddings", status.Done)
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		saveRecord(t, app, docs, map[string]any{"content": "five"})
+		embedder.mu.Lock()
+		embedder.err = errors.New("embedder down")
+		embedder.mu.Unlock()
+		status, err := Reindex(context.Background(), app, config, ReindexOptions{MissingOnly: true})
+		if err == nil || status.Status != ReindexFailed || status.Error != "embedder down" {
+			t.Errorf("got %+v: %v", status, err)
+		}
+		embedder.mu.Lock()
+		embedder.err = nil
+		embedder.mu.Unlock()
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		status, err := Reindex(ctx, app, config, ReindexOptions{})
+		if !errors.Is(err, context.Canceled) || status.Status != ReindexStopped {
+			t.Errorf("got %+v: %v", status, err)
+		}
+		stored, err := reindexStatus(app, "docs")
+		if err != nil || stored.Status != ReindexStopped {
+			t.Errorf("saved %+v: %v", stored, err)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package vector_search
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/resolvers"
+	"github.com/pocketbase/pocketbase/tools/list"
+	"github.com/pocketbase/pocketbase/tools/search"
+)
+
+// checkListRule rejects the requests that can't list the collection at all.
+// Collections without a ListRule can only be searched by admins.
+func checkListRule(collection *models.Collection, info *models.RequestInfo) error {
+	if info != nil && info.Admin == nil && collection.ListRule == nil {
+		return apis.NewForbiddenError("Only admins can perform this action.", nil)
+	}
+	return nil
+}
+
+// visibleRecords loads the records with the given ids that match filter and
+// that the request can list, applying the collection ListRule the same way
+// as the records list API. Every record is visible when info is nil.
+func visibleRecords(app *pocketbase.PocketBase, collection *models.Collection, info *models.RequestInfo, filter string, ids []string) (map[string]*models.Record, error) {
+	if err := checkListRule(collection, info); err != nil {
+		return nil, err
+	}
+	query := app.Dao().RecordQuery(collection).
+		AndWhere(dbx.In("[["+collection.Name+".id]]", list.ToInterfaceSlice(ids)...))
+	admin := info == nil || info.Admin != nil
+	// hidden fields can only be filtered by admins
+	resolver := resolvers.NewRecordFieldResolver(app.Dao(), collection, info, admin)
+	if !admin && *collection.ListRule != "" {
+		expr, err := search.FilterData(*collection.ListRule).BuildExpr(resolver)
+		if err != nil {
+			return nil, err
+		}
+		query.AndWhere(expr)
+	}
+	if filter != "" {
+		expr, err := search.FilterData(filter).BuildExpr(resolver)
+		if err != nil {
+			return nil, apis.NewBadRequestError("Invalid filter.", err)
+		}
+		query.AndWhere(expr)
+	}
+	resolver.UpdateQuery(query)
+
+	records := []*models.Record{}
+	if err := query.All(&records); err != nil {
+		return nil, err
+	}
+	recordsById := map[string]*models.Record{}
+	for _, record := range records {
+		recordsById[record.Id] = record
+	}
+	return recordsById, nil
+}
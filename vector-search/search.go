@@ -0,0 +1,65 @@
+package vector_search
+
+import (
+	"fmt"
+
+	"github.com/ganigeorgiev/fexpr"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// checkSearch rejects the searches the request can't make, before the query
+// is embedded.
+func checkSearch(collection *models.Collection, info *models.RequestInfo, filter string) error {
+	if err := checkListRule(collection, info); err != nil {
+		return err
+	}
+	if filter == "" {
+		return nil
+	}
+	if _, err := fexpr.Parse(filter); err != nil {
+		return apis.NewBadRequestError("Invalid filter.", err)
+	}
+	return checkFilter(filter, info)
+}
+
+// checkK rejects a number of results k that a search can't return.
+func checkK(k int) error {
+	if k <= 0 {
+		return apis.NewBadRequestError("The number of results k must be positive.", nil)
+	}
+	if k > MaxChunkMatches {
+		return apis.NewBadRequestError(fmt.Sprintf("The number of results k can't be more than %d.", MaxChunkMatches), nil)
+	}
+	return nil
+}
+
+// searchRecords returns the k records nearest to vector that match filter
+// and that the request can list, nearest first, with their similarity score
+// and best chunk.
+func searchRecords(app *pocketbase.PocketBase, collection *models.Collection, config VectorCollection, info *models.RequestInfo, vector []float32, k int, filter string) ([]map[string]any, error) {
+	where, whereParams := metadataFilter(collection, config, filter)
+	results, recordsById, err := searchChunks(app, config, vector, k, where, whereParams, func(ids []string) (map[string]*models.Record, error) {
+		return visibleRecords(app, collection, info, filter, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []map[string]any{}
+	for _, result := range results {
+		record, ok := recordsById[result.Record]
+		if !ok {
+			continue
+		}
+		item := record.PublicExport()
+		item["score"] = similarity(config.DistanceMetric, result.Distance)
+		item["chunk"] = map[string]any{
+			"text":   result.Text,
+			"offset": result.Offset,
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,81 @@
+package vector_search
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// DefaultFields feed the embedding of collections without Fields or a
+// Template.
+var DefaultFields = []string{"title", "content"}
+
+// TemplateFuncs are available in the Template of every collection.
+var TemplateFuncs = template.FuncMap{
+	"join": templateJoin,
+}
+
+// parseTemplate parses the Template of the collection, if any.
+func parseTemplate(config *VectorCollection) error {
+	if config.Template == "" {
+		return nil
+	}
+	tmpl, err := template.New(config.Name).Funcs(TemplateFuncs).Option("missingkey=zero").Parse(config.Template)
+	if err != nil {
+		return fmt.Errorf("invalid template for %s: %w", config.Name, err)
+	}
+	config.template = tmpl
+	return nil
+}
+
+// sourceFields are the record fields that feed the embedding, when there is
+// no Template.
+func (config VectorCollection) sourceFields() []string {
+	if len(config.Fields) > 0 {
+		return config.Fields
+	}
+	return DefaultFields
+}
+
+// sourceText is the text embedded for a record: the Template executed with
+// the record fields, or else the non-empty source fields one per paragraph.
+func sourceText(config VectorCollection, record *models.Record) (string, error) {
+	if config.template != nil {
+		data := map[string]any{}
+		for key, value := range record.PublicExport() {
+			data[key] = value
+		}
+		var text strings.Builder
+		if err := config.template.Execute(&text, data); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(text.String()), nil
+	}
+
+	parts := []string{}
+	for _, field := range config.sourceFields() {
+		if value := strings.TrimSpace(record.GetString(field)); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// templateJoin joins the values of multi-value fields, eg. {{join .tags}}.
+func templateJoin(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(v, ", ")
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprint(value)
+}